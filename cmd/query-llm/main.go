@@ -0,0 +1,546 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	queryllm "github.com/ariya/query-llm"
+)
+
+const USAGE = `Usage: query-llm [flags] [command] [arguments]
+
+Commands:
+  chat                 start an interactive session (default)
+  ask question...      answer a single question, or the question from stdin
+  eval file...         evaluate the test files
+  compare file...      evaluate the test files against several models, side by side
+  serve                serve the pipeline as an OpenAI-compatible API
+  web                  serve the web chat UI
+  mcp                  serve the pipeline as an MCP server over stdio
+  trace show file      print the turns recorded in a trace log
+  prompts dump [dir]   write the built-in prompt templates, as a starting point for --prompt-dir
+
+Run 'query-llm command --help' for the flags specific to a command.
+
+Flags, accepted by every command, take precedence over the environment variables,
+which take precedence over the selected profile in the config file:
+`
+
+// toggle is a boolean flag which sets every target to its value, or to the opposite value if inverted.
+type toggle struct {
+	targets  []*bool
+	inverted bool
+}
+
+func (t toggle) String() string {
+	return ""
+}
+
+func (t toggle) Set(value string) error {
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	for _, target := range t.targets {
+		*target = enabled != t.inverted
+	}
+	return nil
+}
+
+func (t toggle) IsBoolFlag() bool {
+	return true
+}
+
+// secret is a string flag whose value is never printed, e.g. in the usage.
+type secret struct {
+	target *string
+}
+
+func (s secret) String() string {
+	return ""
+}
+
+func (s secret) Set(value string) error {
+	*s.target = value
+	return nil
+}
+
+// configure registers the flags mirroring the LLM_* environment variables.
+// Since the current config (from the profile and the environment) is their default, the flags take precedence.
+func configure(flags *flag.FlagSet, config *queryllm.Config) {
+	flags.StringVar(&config.Profile, "profile", config.Profile, "the `name` of the profile in "+queryllm.ConfigFile()+" (LLM_PROFILE)")
+	flags.StringVar(&config.BaseURL, "base-url", config.BaseURL, "the base `URL` of the LLM service (LLM_API_BASE_URL)")
+	flags.Var(secret{&config.APIKey}, "api-key", "the API `key` of the LLM service (LLM_API_KEY)")
+	flags.StringVar(&config.ChatModel, "model", config.ChatModel, "the chat `model` (LLM_CHAT_MODEL)")
+	flags.StringVar(&config.EmbeddingModel, "embedding-model", config.EmbeddingModel, "the embedding `model` for similarity assertions (LLM_EMBEDDING_MODEL)")
+	flags.BoolVar(&config.JSONSchema, "json-schema", config.JSONSchema, "constrain the completions to JSON with a schema (LLM_JSON_SCHEMA)")
+	flags.Var(toggle{[]*bool{&config.Streaming}, true}, "no-stream", "disable the streaming of the answer (LLM_STREAMING=no)")
+	flags.BoolVar(&config.ZeroShot, "zero-shot", config.ZeroShot, "use the zero-shot pipeline instead of chain-of-thought (LLM_ZERO_SHOT)")
+	flags.StringVar(&config.PromptDir, "prompt-dir", config.PromptDir, "load the prompt templates from `dir` (LLM_PROMPT_DIR)")
+	flags.StringVar(&config.ExampleFile, "example-file", config.ExampleFile, "the JSONL `file` of few-shot examples for the reasoning (LLM_EXAMPLE_FILE)")
+	flags.IntVar(&config.ExampleCount, "example-count", config.ExampleCount, "give the `N` most relevant examples to the reasoning (LLM_EXAMPLE_COUNT)")
+	flags.StringVar(&config.ExampleMatch, "example-match", config.ExampleMatch, "pick the examples by keyword or embedding (LLM_EXAMPLE_MATCH)")
+	flags.StringVar(&config.Language, "language", config.Language, "answer in the `language` (a name or code), or auto to detect it from the inquiry (LLM_LANGUAGE)")
+	flags.StringVar(&config.PriceTable, "price-table", config.PriceTable, "the JSON `file` with the price of every model (LLM_PRICE_TABLE)")
+	flags.StringVar(&config.OTLPEndpoint, "otlp-endpoint", config.OTLPEndpoint, "export OpenTelemetry traces to the collector at `URL` (LLM_OTLP_ENDPOINT)")
+	flags.StringVar(&config.OTLPFile, "otlp-file", config.OTLPFile, "append OpenTelemetry traces to `file` (LLM_OTLP_FILE)")
+	flags.StringVar(&config.TraceFile, "trace-file", config.TraceFile, "append the trace log of every run to `file` (LLM_TRACE_FILE)")
+	flags.StringVar(&config.MCPConfig, "mcp-config", config.MCPConfig, "the JSON `file` listing the MCP servers to use as tools (LLM_MCP_CONFIG)")
+	flags.Var(toggle{[]*bool{&config.DebugChat, &config.DebugPipeline}, false}, "debug", "print every chat message and the review of every pipeline")
+	flags.BoolVar(&config.DebugChat, "debug-chat", config.DebugChat, "print every chat message (LLM_DEBUG_CHAT)")
+	flags.BoolVar(&config.DebugPipeline, "debug-pipeline", config.DebugPipeline, "print the review of every pipeline (LLM_DEBUG_PIPELINE)")
+	flags.BoolVar(&config.DebugFailExit, "debug-fail-exit", config.DebugFailExit, "stop the evaluation at the first failure (LLM_DEBUG_FAIL_EXIT)")
+}
+
+// profile returns the name of the profile selected with --profile anywhere in the arguments, or else with LLM_PROFILE.
+// Since the profile provides the defaults of the other flags, it is looked up before parsing them.
+func profile(args []string) string {
+	name := os.Getenv("LLM_PROFILE")
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		for _, prefix := range []string{"-profile", "--profile"} {
+			if arg == prefix && i+1 < len(args) {
+				name = args[i+1]
+			}
+			if strings.HasPrefix(arg, prefix+"=") {
+				name = strings.TrimPrefix(arg, prefix+"=")
+			}
+		}
+	}
+	return name
+}
+
+// command creates the flag set of a command, including the flags of the config.
+func command(name, synopsis string, config *queryllm.Config) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	configure(flags, config)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: query-llm %s\n\nFlags:\n", synopsis)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parse parses the flags, which may be interleaved with the positional arguments.
+func parse(flags *flag.FlagSet, args []string) []string {
+	var positionals []string
+	for len(args) > 0 {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) > 0 {
+			positionals = append(positionals, args[0])
+			args = args[1:]
+		}
+	}
+	return positionals
+}
+
+// pipeline registers --pipeline, which selects the pipeline by name as serve, web, and mcp did in the earlier versions.
+// It is deprecated in favor of --zero-shot, accepted by every command.
+func pipeline(flags *flag.FlagSet, config *queryllm.Config) {
+	flags.Func("pipeline", "deprecated, use --zero-shot instead: the pipeline `name`, chain-of-thought or zero-shot", func(name string) error {
+		switch name {
+		case "zero-shot":
+			config.ZeroShot = true
+		case "chain-of-thought":
+			config.ZeroShot = false
+		default:
+			return fmt.Errorf("unknown pipeline %q (must be zero-shot or chain-of-thought)", name)
+		}
+		fmt.Fprintln(os.Stderr, "WARNING: --pipeline is deprecated, use --zero-shot instead")
+		return nil
+	})
+}
+
+// legacy checks whether the arguments, which the top-level flags do not accept, are those of an evaluation
+// as given directly in the earlier versions, e.g. "--repeat 3 tests/x.txt".
+func legacy(args []string) bool {
+	for _, arg := range args {
+		if info, err := os.Stat(arg); err == nil && !info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// compile compiles the case-insensitive regular expression, if any.
+func compile(pattern string) *regexp.Regexp {
+	if pattern == "" {
+		return nil
+	}
+	regex, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		exit(-1)
+	}
+	return regex
+}
+
+// connected is the client created by connect, to be closed by exit.
+var connected *queryllm.Client
+
+// connect creates the client for the config, printing its progress to stdout.
+func connect(config queryllm.Config) *queryllm.Client {
+	connected = queryllm.NewClient(config)
+	connected.Output = os.Stdout
+	return connected
+}
+
+// exit stops the MCP servers launched by the client, if any, before exiting with the status code.
+func exit(code int) {
+	if connected != nil {
+		connected.Close()
+	}
+	os.Exit(code)
+}
+
+// banner prints the LLM service being used.
+func banner(client *queryllm.Client) {
+	if client.Profile != "" {
+		fmt.Printf("Using LLM at %s (model: %s%s%s, profile: %s).\n", client.BaseURL, queryllm.GREEN, client.ChatModel, queryllm.NORMAL, client.Profile)
+		return
+	}
+	fmt.Printf("Using LLM at %s (model: %s%s%s).\n", client.BaseURL, queryllm.GREEN, client.ChatModel, queryllm.NORMAL)
+}
+
+func ask(config queryllm.Config, args []string) {
+	flags := command("ask", "ask [flags] question...", &config)
+	words := parse(flags, args)
+	inquiry := strings.Join(words, " ")
+	if len(words) == 0 {
+		input, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			exit(-1)
+		}
+		inquiry = strings.TrimSpace(string(input))
+	}
+	if inquiry == "" {
+		flags.Usage()
+		exit(-1)
+	}
+
+	client := connect(config)
+	streamed := false
+	turn, err := client.Ask(inquiry, nil, func(text string) {
+		streamed = streamed || len(text) > 0
+		fmt.Print(text)
+	}, func(answer string) {
+		fmt.Printf("\n%s%s Repaired answer:%s\n%s", queryllm.GRAY, queryllm.ARROW, queryllm.NORMAL, answer)
+	})
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		exit(-1)
+	}
+	if !streamed {
+		fmt.Print(turn.Answer)
+	}
+	fmt.Println()
+}
+
+func chat(config queryllm.Config, args []string) {
+	flags := command("chat", "chat [flags]", &config)
+	reviewFile := flags.String("review", "", "write the pipeline review of every turn as HTML to `file`")
+	parse(flags, args)
+
+	client := connect(config)
+	banner(client)
+	if err := client.Interact(os.Stdin, *reviewFile); err != nil {
+		fmt.Println("ERROR:", err)
+		exit(-1)
+	}
+}
+
+func evaluate(config queryllm.Config, args []string) {
+	flags := command("eval", "eval [flags] file...", &config)
+	repeat := flags.Int("repeat", 1, "run every test `N` times to measure the flakiness")
+	reportFile := flags.String("report", "", "write the evaluation report as JSON to `file`")
+	saveBaseline := flags.String("save-baseline", "", "save the outcome of every inquiry as a baseline to `file`")
+	compareBaseline := flags.String("compare-baseline", "", "compare the outcome of every inquiry to the baseline in `file`")
+	story := flags.String("story", "", "evaluate only the stories whose name matches the `regex`")
+	grep := flags.String("grep", "", "evaluate only the inquiries matching the `regex`")
+	tags := flags.String("tags", "", "evaluate only the stories having any of the comma-separated `tags`")
+	reviewFile := flags.String("review", "", "write the pipeline review of every turn as HTML to `file`")
+	failedOnly := flags.String("failed-only", "", "evaluate only the inquiries which failed in the previous report `file` (see --report)")
+	files := parse(flags, args)
+	if len(files) == 0 {
+		flags.Usage()
+		exit(-1)
+	}
+	if *repeat < 1 {
+		*repeat = 1
+	}
+
+	filter := queryllm.Filter{Story: compile(*story), Grep: compile(*grep)}
+	if *tags != "" {
+		filter.Tags = strings.Split(*tags, ",")
+	}
+	if *failedOnly != "" {
+		previous, _ := filepath.Abs(*failedOnly)
+		if output, _ := filepath.Abs(*reportFile); *reportFile != "" && output == previous {
+			fmt.Println("ERROR: --report would overwrite the previous report of --failed-only, use another file")
+			exit(-1)
+		}
+		var last queryllm.Report
+		jsonData, err := os.ReadFile(*failedOnly)
+		if err == nil {
+			err = json.Unmarshal(jsonData, &last)
+		}
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			exit(-1)
+		}
+		filter.Failed = make(map[string]bool)
+		for _, question := range last.Questions {
+			if question.Status != "pass" {
+				filter.Failed[queryllm.Identify(question.File, question.StoryIndex, question.TurnIndex)] = true
+			}
+		}
+	}
+
+	var baseline []queryllm.Snapshot
+	if *compareBaseline != "" {
+		var err error
+		if baseline, err = queryllm.LoadBaseline(*compareBaseline); err != nil {
+			fmt.Println("ERROR:", err)
+			exit(-1)
+		}
+	}
+
+	client := connect(config)
+	banner(client)
+
+	var questions []queryllm.Question
+	for _, file := range files {
+		evaluated, err := client.Evaluate(file, *repeat, filter)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			exit(-1)
+		}
+		questions = append(questions, evaluated...)
+	}
+	report := client.Summarize(questions, *repeat)
+	queryllm.Recap(os.Stdout, report)
+	if *reviewFile != "" {
+		if err := client.ExportReview(questions, *reviewFile); err != nil {
+			fmt.Println("ERROR:", err)
+			exit(-1)
+		}
+	}
+	if *reportFile != "" {
+		jsonData, _ := json.MarshalIndent(report, "", "  ")
+		if err := os.WriteFile(*reportFile, jsonData, 0644); err != nil {
+			fmt.Println("ERROR:", err)
+			exit(-1)
+		}
+	}
+	if *compareBaseline != "" {
+		queryllm.Regression(os.Stdout, baseline, queryllm.Baseline(questions))
+	}
+	if *saveBaseline != "" {
+		jsonData, _ := json.MarshalIndent(queryllm.Baseline(questions), "", "  ")
+		if err := os.WriteFile(*saveBaseline, jsonData, 0644); err != nil {
+			fmt.Println("ERROR:", err)
+			exit(-1)
+		}
+	}
+	if report.Passed < report.Total {
+		exit(-1)
+	}
+}
+
+func compare(config queryllm.Config, args []string) {
+	flags := command("compare", "compare [flags] file...", &config)
+	models := flags.String("models", config.ChatModel, "comma-separated `list` of models, each as model, model@profile, or model@base-url (without an API key)")
+	repeat := flags.Int("repeat", 1, "run every test `N` times to measure the flakiness")
+	csvFile := flags.String("csv", "", "write the comparison matrix as CSV to `file`")
+	htmlFile := flags.String("html", "", "write the comparison matrix as HTML to `file`")
+	files := parse(flags, args)
+	if len(files) == 0 {
+		flags.Usage()
+		exit(-1)
+	}
+	if *repeat < 1 {
+		*repeat = 1
+	}
+
+	client := connect(config)
+	reports, err := client.Contrast(strings.Split(*models, ","), files, *repeat)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		exit(-1)
+	}
+	queryllm.Tabulate(os.Stdout, reports)
+	if *csvFile != "" {
+		if err := queryllm.ExportCSV(reports, *csvFile); err != nil {
+			fmt.Println("ERROR:", err)
+			exit(-1)
+		}
+	}
+	if *htmlFile != "" {
+		if err := queryllm.ExportHTML(reports, *htmlFile); err != nil {
+			fmt.Println("ERROR:", err)
+			exit(-1)
+		}
+	}
+	for _, report := range reports {
+		if report.Passed < report.Total {
+			exit(-1)
+		}
+	}
+}
+
+func serve(config queryllm.Config, args []string, name string) {
+	flags := command(name, name+" [flags]", &config)
+	address := flags.String("addr", "127.0.0.1:8000", "listen on the `address`")
+	pipeline(flags, &config)
+	parse(flags, args)
+
+	client := connect(config)
+	banner(client)
+	start := client.Serve
+	if name == "web" {
+		start = client.Web
+	}
+	if err := start(*address); err != nil {
+		fmt.Println("ERROR:", err)
+		exit(-1)
+	}
+}
+
+func mcp(config queryllm.Config, args []string) {
+	flags := command("mcp", "mcp [flags]", &config)
+	pipeline(flags, &config)
+	parse(flags, args)
+
+	// stdout carries the protocol, hence the progress goes to stderr
+	client := connect(config)
+	client.Output = os.Stderr
+	if err := client.MCP(os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		exit(-1)
+	}
+}
+
+func trace(config queryllm.Config, args []string) {
+	flags := command("trace", "trace show [flags] trace-file", &config)
+	story := flags.String("story", "", "show only the turns whose story name matches the `regex`")
+	grep := flags.String("grep", "", "show only the turns whose inquiry matches the `regex`")
+	stage := flags.String("stage", "", "show only the exchanges of the pipeline stage `name`")
+	failed := flags.Bool("failed", false, "show only the turns which failed or did not complete")
+	raw := flags.Bool("json", false, "print the matching records as JSON lines")
+	positionals := parse(flags, args)
+	if len(positionals) != 2 || positionals[0] != "show" {
+		flags.Usage()
+		exit(-1)
+	}
+
+	client := connect(config)
+	filter := queryllm.Filter{Story: compile(*story), Grep: compile(*grep)}
+	if err := client.Show(positionals[1], filter, *stage, *failed, *raw); err != nil {
+		fmt.Println("ERROR:", err)
+		exit(-1)
+	}
+}
+
+func prompts(config queryllm.Config, args []string) {
+	flags := command("prompts", "prompts dump [flags] [dir]", &config)
+	force := flags.Bool("force", false, "overwrite the existing files")
+	positionals := parse(flags, args)
+	if len(positionals) < 1 || len(positionals) > 2 || positionals[0] != "dump" {
+		flags.Usage()
+		exit(-1)
+	}
+
+	dir := config.PromptDir
+	if len(positionals) == 2 {
+		dir = positionals[1]
+	}
+	if dir == "" {
+		dir = "prompts"
+	}
+	written, err := queryllm.ExportPrompts(dir, *force)
+	for _, filename := range written {
+		fmt.Println("Wrote", filename)
+	}
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		exit(-1)
+	}
+}
+
+func main() {
+	config, err := queryllm.Load(profile(os.Args[1:]))
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		exit(-1)
+	}
+	flags := flag.NewFlagSet("query-llm", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	configure(flags, &config)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), USAGE)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		flags.SetOutput(os.Stderr)
+		if err == flag.ErrHelp {
+			flags.Usage()
+			exit(0)
+		}
+		// the evaluation flags before the test files, as given directly in the earlier versions
+		if legacy(os.Args[1:]) {
+			evaluate(config, os.Args[1:])
+			exit(0)
+		}
+		fmt.Fprintln(flags.Output(), err)
+		flags.Usage()
+		exit(2)
+	}
+	args := flags.Args()
+	if len(args) == 0 {
+		chat(config, args)
+		exit(0)
+	}
+
+	switch args[0] {
+	case "chat":
+		chat(config, args[1:])
+	case "ask":
+		ask(config, args[1:])
+	case "eval":
+		evaluate(config, args[1:])
+	case "compare":
+		compare(config, args[1:])
+	case "serve", "web":
+		serve(config, args[1:], args[0])
+	case "mcp":
+		mcp(config, args[1:])
+	case "trace":
+		trace(config, args[1:])
+	case "prompts":
+		prompts(config, args[1:])
+	case "help":
+		flags.SetOutput(os.Stdout)
+		flags.Usage()
+	default:
+		// the test files, as given directly in the earlier versions
+		if _, err := os.Stat(args[0]); err == nil {
+			evaluate(config, args)
+			break
+		}
+		fmt.Println("ERROR: unknown command:", args[0])
+		flags.Usage()
+		exit(-1)
+	}
+	exit(0)
+}
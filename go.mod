@@ -0,0 +1,3 @@
+module github.com/ariya/query-llm
+
+go 1.18
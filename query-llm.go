@@ -1,70 +1,145 @@
-package main
+// Package queryllm answers inquiries with an LLM, using either a zero-shot or a chain-of-thought pipeline,
+// and evaluates the answers against test files. The query-llm command is a thin wrapper around it.
+package queryllm
 
 import (
 	"bufio"
 	"bytes"
+	gocontext "context"
+	"crypto/rand"
+	_ "embed"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
+	"math"
 	"net/http"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	txttemplate "text/template"
 	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
 var (
-	LLMAPIBaseURL = func() string {
-		if os.Getenv("LLM_API_BASE_URL") != "" {
-			return os.Getenv("LLM_API_BASE_URL")
-		} else {
-			return "https://api.openai.com/v1"
-		}
-	}()
-	LLMAPIKey = func() string {
-		if os.Getenv("LLM_API_KEY") != "" {
-			return os.Getenv("LLM_API_KEY")
-		} else {
-			return os.Getenv("OPENAI_API_KEY")
-		}
-	}()
-	LLMChatModel = func() string {
-		if os.Getenv("LLM_CHAT_MODEL") != "" {
-			return os.Getenv("LLM_CHAT_MODEL")
-		} else {
-			return "gpt-4o-mini"
-		}
-	}()
-	LLMStreaming  = os.Getenv("LLM_STREAMING") != "no"
-	LLMJsonSchema = os.Getenv("LLM_JSON_SCHEMA")
+	PREDEFINED_KEYS = []string{"inquiry", "tool", "thought", "keyphrases", "observation", "answer", "topic"}
+	TOOL_KEYS       = []string{"inquiry", "tool", "arguments", "thought", "keyphrases", "observation", "answer", "topic"} // with the tools from MCP servers
 
-	LLMZeroShot      = os.Getenv("LLM_ZERO_SHOT")
-	LLMDebugChat     = os.Getenv("LLM_DEBUG_CHAT")
-	LLMDebugPipeline = os.Getenv("LLM_DEBUG_PIPELINE")
-	LLMDebugFailExit = os.Getenv("LLM_DEBUG_FAIL_EXIT")
+	// PROMPTS holds the built-in templates of the system prompts, one for every pipeline stage.
+	// See Setting for the data available to them, and ExportPrompts to customize them.
+	PROMPTS = map[string]string{
+		"reason": `---
+schema: reason
+---
+{{- if .Tools -}}
+{{- $names := "Google"}}{{range .Tools}}{{$names = printf "%s, %s" $names .Name}}{{end -}}
+Use Google to search for the answer, unless one of the following tools is more suitable.
+Think step by step.
+{{- if .Language}}
+The inquiry may be in another language, but always write your thought, keyphrases, and observation in English.
+{{- end}}
 
-	PREDEFINED_KEYS = []string{"inquiry", "tool", "thought", "keyphrases", "observation", "answer", "topic"}
+Tools:
+{{- range .Tools}}
+- {{.Name}}: {{trim .Description}} Arguments (JSON schema): {{json .InputSchema}}
+{{- end}}
 
-	REASON_PROMPT = `Use Google to search for the answer. Think step by step.
-Always output your thought in following format`
-	REASON_GUIDELINE = map[string]string{
-		"tool":        "the search engine to use (must be Google)",
-		"thought":     "describe your thoughts about the inquiry",
-		"keyphrases":  "the important key phrases to search for",
-		"observation": "the concise result of the search tool",
-		"topic":       "the specific topic covering the inquiry",
-	}
-	REASON_EXAMPLE_INQUIRY = `
+Always output your thought in following format
+{{- format
+	"tool" (printf "the tool to use (must be one of %s)" $names)
+	"arguments" "the arguments for the tool, as JSON in a single line (empty for Google)"
+	"thought" "describe your thoughts about the inquiry"
+	"keyphrases" "the important key phrases to search for"
+	"observation" "the concise result of the tool"
+	"topic" "the specific topic covering the inquiry"
+}}
+{{- else -}}
+Use Google to search for the answer. Think step by step.
+{{- if .Language}}
+The inquiry may be in another language, but always write your thought, keyphrases, and observation in English.
+{{- end}}
+Always output your thought in following format
+{{- format
+	"tool" "the search engine to use (must be Google)"
+	"thought" "describe your thoughts about the inquiry"
+	"keyphrases" "the important key phrases to search for"
+	"observation" "the concise result of the search tool"
+	"topic" "the specific topic covering the inquiry"
+}}
+{{- end}}
+{{- if not (or .History .Examples)}}
 Example:
 
-Given an inquiry "What is Pitch Lake in Trinidad famous for?", you will output:`
-	REASON_EXAMPLE_OUTPUT = map[string]string{
-		"tool":        "Google",
-		"thought":     "This is about geography, I will use Google search",
-		"keyphrases":  "Pitch Lake in Trinidad fame",
-		"observation": "Pitch Lake in Trinidad is the largest natural deposit of asphalt",
-		"topic":       "geography",
+Given an inquiry "What is Pitch Lake in Trinidad famous for?", you will output:
+{{- if .Tools}}
+{{- format
+	"tool" "Google"
+	"arguments" ""
+	"thought" "This is about geography, I will use Google search"
+	"keyphrases" "Pitch Lake in Trinidad fame"
+	"observation" "Pitch Lake in Trinidad is the largest natural deposit of asphalt"
+	"topic" "geography"
+}}
+{{- else}}
+{{- format
+	"tool" "Google"
+	"thought" "This is about geography, I will use Google search"
+	"keyphrases" "Pitch Lake in Trinidad fame"
+	"observation" "Pitch Lake in Trinidad is the largest natural deposit of asphalt"
+	"topic" "geography"
+}}
+{{- end}}
+{{- end}}
+`,
+		"respond": `---
+schema: respond
+---
+You are an assistant for question-answering tasks.
+You are digesting the most recent user's inquiry, thought, and observation.
+Your task is to use the observation to answer the inquiry politely and concisely.
+You may need to refer to the user's conversation history to understand some context.
+There is no need to mention "based on the observation" or "based on the previous conversation" in your answer.
+Your answer is in simple {{or .Language "English"}}, and at max 3 sentences.
+Do not make any apology or other commentary.
+Do not use other sources of information, including your memory.
+Do not make up new names or come up with new facts.
+{{- if .JSONSchema}}
+Always answer in JSON with the following format:
+
+{
+    "answer": // accurate and polite answer
+}
+{{- end}}
+{{- if .History}}
+
+For your reference, you and the user have the following Q&A discussion:
+{{range .History}}* {{.Inquiry}} {{.Answer}}
+{{end}}
+{{- end}}
+`,
+		"reply": `---
+schema: none
+---
+You are a helpful answering assistant.
+Your task is to reply and respond to the user politely and concisely.
+Answer in plain text and not in Markdown format.
+{{- if .Language}}
+Always answer in {{.Language}}.
+{{- end}}
+`,
 	}
+
 	REASON_SCHEMA = map[string]interface{}{
 		"type":                 "object",
 		"additionalProperties": false,
@@ -94,21 +169,6 @@ Given an inquiry "What is Pitch Lake in Trinidad famous for?", you will output:`
 		},
 	}
 
-	RESPOND_PROMPT = `You are an assistant for question-answering tasks.
-You are digesting the most recent user's inquiry, thought, and observation.
-Your task is to use the observation to answer the inquiry politely and concisely.
-You may need to refer to the user's conversation history to understand some context.
-There is no need to mention "based on the observation" or "based on the previous conversation" in your answer.
-Your answer is in simple English, and at max 3 sentences.
-Do not make any apology or other commentary.
-Do not use other sources of information, including your memory.
-Do not make up new names or come up with new facts.`
-	RESPOND_GUIDELINE = `
-Always answer in JSON with the following format:
-
-{
-    "answer": // accurate and polite answer
-}`
 	RESPOND_SCHEMA = map[string]interface{}{
 		"type":                 "object",
 		"additionalProperties": false,
@@ -122,11 +182,69 @@ Always answer in JSON with the following format:
 		},
 	}
 
-	REPLY_PROMPT = `You are a helpful answering assistant.
-Your task is to reply and respond to the user politely and concisely.
-Answer in plain text and not in Markdown format.`
+	// LANGUAGES holds the languages known to the detector, each with a sample text from which its trigram profile is built.
+	LANGUAGES = []Language{
+		{Code: "en", Name: "English", Sample: `What is the largest planet in our solar system? Who wrote the first novel, and when was it published?
+How many people live in the capital city of this country? The weather is very nice today, so we are going to the beach with our friends.
+Where can I find the best coffee in town? Which year did the war end? I would like to know why the sky is blue during the day.
+Please tell me something about the history of the city and the people who built it. She has been working there for more than ten years.
+They said that the new bridge would be finished by the end of next month, but nobody believes it.`},
+		{Code: "id", Name: "Indonesian", Sample: `Apa planet terbesar di tata surya kita? Siapa yang menulis novel pertama, dan kapan novel itu diterbitkan?
+Berapa banyak orang yang tinggal di ibu kota negara ini? Cuaca hari ini sangat bagus, jadi kami akan pergi ke pantai bersama teman-teman.
+Di mana saya bisa menemukan kopi terbaik di kota ini? Pada tahun berapa perang itu berakhir? Saya ingin tahu mengapa langit berwarna biru pada siang hari.
+Tolong ceritakan sesuatu tentang sejarah kota ini dan orang-orang yang membangunnya. Dia sudah bekerja di sana selama lebih dari sepuluh tahun.
+Mereka mengatakan bahwa jembatan baru itu akan selesai pada akhir bulan depan, tetapi tidak ada yang percaya.`},
+		{Code: "de", Name: "German", Sample: `Was ist der größte Planet in unserem Sonnensystem? Wer hat den ersten Roman geschrieben, und wann wurde er veröffentlicht?
+Wie viele Menschen leben in der Hauptstadt dieses Landes? Das Wetter ist heute sehr schön, deshalb gehen wir mit unseren Freunden an den Strand.
+Wo kann ich den besten Kaffee in der Stadt finden? In welchem Jahr endete der Krieg? Ich möchte wissen, warum der Himmel am Tag blau ist.
+Bitte erzähl mir etwas über die Geschichte der Stadt und die Menschen, die sie gebaut haben. Sie arbeitet dort schon seit mehr als zehn Jahren.
+Sie sagten, dass die neue Brücke bis Ende nächsten Monats fertig sein würde, aber niemand glaubt es.`},
+		{Code: "fr", Name: "French", Sample: `Quelle est la plus grande planète de notre système solaire ? Qui a écrit le premier roman, et quand a-t-il été publié ?
+Combien de personnes vivent dans la capitale de ce pays ? Il fait très beau aujourd'hui, alors nous allons à la plage avec nos amis.
+Où puis-je trouver le meilleur café de la ville ? En quelle année la guerre s'est-elle terminée ? Je voudrais savoir pourquoi le ciel est bleu pendant la journée.
+Parle-moi un peu de l'histoire de la ville et des gens qui l'ont construite. Elle travaille là-bas depuis plus de dix ans.
+Ils ont dit que le nouveau pont serait terminé à la fin du mois prochain, mais personne ne le croit.`},
+		{Code: "es", Name: "Spanish", Sample: `¿Cuál es el planeta más grande de nuestro sistema solar? ¿Quién escribió la primera novela, y cuándo se publicó?
+¿Cuántas personas viven en la capital de este país? Hoy hace muy buen tiempo, así que vamos a la playa con nuestros amigos.
+¿Dónde puedo encontrar el mejor café de la ciudad? ¿En qué año terminó la guerra? Me gustaría saber por qué el cielo es azul durante el día.
+Por favor, cuéntame algo sobre la historia de la ciudad y de la gente que la construyó. Ella lleva más de diez años trabajando allí.
+Dijeron que el nuevo puente estaría terminado a finales del próximo mes, pero nadie lo cree.`},
+		{Code: "nl", Name: "Dutch", Sample: `Wat is de grootste planeet in ons zonnestelsel? Wie schreef de eerste roman, en wanneer werd die gepubliceerd?
+Hoeveel mensen wonen er in de hoofdstad van dit land? Het weer is vandaag erg mooi, dus we gaan met onze vrienden naar het strand.
+Waar kan ik de beste koffie in de stad vinden? In welk jaar eindigde de oorlog? Ik wil graag weten waarom de lucht overdag blauw is.
+Vertel me alsjeblieft iets over de geschiedenis van de stad en de mensen die haar hebben gebouwd. Zij werkt daar al meer dan tien jaar.
+Ze zeiden dat de nieuwe brug tegen het einde van volgende maand klaar zou zijn, maar niemand gelooft het.`},
+		{Code: "it", Name: "Italian", Sample: `Qual è il pianeta più grande del nostro sistema solare? Chi ha scritto il primo romanzo, e quando è stato pubblicato?
+Quante persone vivono nella capitale di questo paese? Oggi il tempo è molto bello, quindi andiamo al mare con i nostri amici.
+Dove posso trovare il caffè migliore della città? In quale anno è finita la guerra? Vorrei sapere perché il cielo è blu durante il giorno.
+Per favore, raccontami qualcosa sulla storia della città e sulle persone che l'hanno costruita. Lei lavora lì da più di dieci anni.
+Hanno detto che il nuovo ponte sarebbe stato finito entro la fine del mese prossimo, ma nessuno ci crede.`},
+		{Code: "pt", Name: "Portuguese", Sample: `Qual é o maior planeta do nosso sistema solar? Quem escreveu o primeiro romance, e quando foi publicado?
+Quantas pessoas vivem na capital deste país? O tempo está muito bom hoje, então vamos à praia com os nossos amigos.
+Onde posso encontrar o melhor café da cidade? Em que ano terminou a guerra? Gostaria de saber por que o céu é azul durante o dia.
+Por favor, conte-me algo sobre a história da cidade e das pessoas que a construíram. Ela trabalha lá há mais de dez anos.
+Disseram que a nova ponte estaria pronta no final do próximo mês, mas ninguém acredita nisso.`},
+	}
+
+	// SCHEMAS holds the built-in schemas, which the prompt templates refer to by name.
+	SCHEMAS = map[string]map[string]interface{}{
+		"reason":  REASON_SCHEMA,
+		"respond": RESPOND_SCHEMA,
+	}
 )
 
+// traces serializes the appending to the trace log, shared by every client.
+var traces sync.Mutex
+
+// profiles holds the trigram profile of every language, built once on demand.
+var profiles struct {
+	sync.Once
+	table map[string]map[string]float64
+}
+
+//go:embed web/index.html
+var WEB_UI string
+
 const (
 	NORMAL  = "\x1b[0m"
 	BOLD    = "\x1b[1m"
@@ -141,11 +259,336 @@ const (
 	CROSS   = "✘"
 
 	MAX_RETRY_ATTEMPT  = 3
+	MAX_REPAIR_ATTEMPT = 2
 	TIMEOUT_IN_SECONDS = 17
 	MAX_TOKENS         = 200
 	TEMPERATURE        = 0 // produces most deterministic
+
+	SIMILARITY_THRESHOLD = 0.85
+	LANGUAGE_THRESHOLD   = 0.15
+	EXAMPLE_THRESHOLD    = 0.3 // the minimum similarity of an example picked by embedding
+
+	MCP_TIMEOUT_IN_SECONDS = 30 // of every request to an MCP server
+	MCP_GRACE_IN_SECONDS   = 3  // for an MCP server to exit on its own, before it is killed
+
+	EXPECT_KEY   = 0
+	EXPECT_COLON = 1
+	EXPECT_VALUE = 2
+	EXPECT_COMMA = 3
+
+	SPAN_KIND_INTERNAL = 1
+	SPAN_KIND_CLIENT   = 3
+	STATUS_CODE_ERROR  = 2
 )
 
+// Config holds the settings of the LLM service and of the pipeline.
+type Config struct {
+	Profile        string
+	BaseURL        string
+	APIKey         string
+	ChatModel      string
+	EmbeddingModel string
+	Streaming      bool
+	JSONSchema     bool
+	ZeroShot       bool
+	Stages         map[string]Override
+	PromptDir      string
+	ExampleFile    string
+	ExampleCount   int
+	ExampleMatch   string // keyword or embedding
+	Language       string // of the answer: a name or code from LANGUAGES, auto to detect it, or empty for English
+
+	PriceTable   string
+	OTLPEndpoint string
+	OTLPFile     string
+	TraceFile    string
+	MCPConfig    string
+
+	DebugChat     bool
+	DebugPipeline bool
+	DebugFailExit bool
+}
+
+// Override replaces the LLM service and the model used by a particular pipeline stage, when not empty.
+type Override struct {
+	BaseURL   string
+	APIKey    string
+	ChatModel string
+}
+
+// Profile is a named set of settings in the config file, e.g. for one LLM service.
+// Only the base URL, the API key (or its command), and the model apply to the per-stage overrides.
+type Profile struct {
+	BaseURL        string             `json:"base_url"`
+	APIKey         string             `json:"api_key"`
+	APIKeyCommand  string             `json:"api_key_command"`
+	Model          string             `json:"model"`
+	EmbeddingModel string             `json:"embedding_model"`
+	Streaming      *bool              `json:"streaming"`
+	JSONSchema     *bool              `json:"json_schema"`
+	Pipeline       string             `json:"pipeline"`
+	PromptDir      string             `json:"prompt_dir"`
+	ExampleFile    string             `json:"example_file"`
+	ExampleCount   int                `json:"example_count"`
+	ExampleMatch   string             `json:"example_match"`
+	Language       string             `json:"language"`
+	Stages         map[string]Profile `json:"stages"`
+}
+
+// initial returns the config with the default settings.
+func initial() Config {
+	return Config{
+		BaseURL:        "https://api.openai.com/v1",
+		APIKey:         os.Getenv("OPENAI_API_KEY"),
+		ChatModel:      "gpt-4o-mini",
+		EmbeddingModel: "text-embedding-3-small",
+		Streaming:      true,
+		ExampleCount:   3,
+		ExampleMatch:   "keyword",
+	}
+}
+
+// environment overrides the config with the LLM_* environment variables which are set.
+func environment(config Config) Config {
+	text := func(name string, target *string) {
+		if os.Getenv(name) != "" {
+			*target = os.Getenv(name)
+		}
+	}
+	flag := func(name string, target *bool) {
+		if os.Getenv(name) != "" {
+			*target = true
+		}
+	}
+	text("LLM_API_BASE_URL", &config.BaseURL)
+	text("LLM_API_KEY", &config.APIKey)
+	text("LLM_CHAT_MODEL", &config.ChatModel)
+	text("LLM_EMBEDDING_MODEL", &config.EmbeddingModel)
+	if os.Getenv("LLM_STREAMING") != "" {
+		config.Streaming = os.Getenv("LLM_STREAMING") != "no"
+	}
+	flag("LLM_JSON_SCHEMA", &config.JSONSchema)
+	flag("LLM_ZERO_SHOT", &config.ZeroShot)
+	text("LLM_PROMPT_DIR", &config.PromptDir)
+	text("LLM_EXAMPLE_FILE", &config.ExampleFile)
+	if count, err := strconv.Atoi(os.Getenv("LLM_EXAMPLE_COUNT")); err == nil {
+		config.ExampleCount = count
+	}
+	text("LLM_EXAMPLE_MATCH", &config.ExampleMatch)
+	text("LLM_LANGUAGE", &config.Language)
+
+	text("LLM_PRICE_TABLE", &config.PriceTable)
+	text("LLM_OTLP_ENDPOINT", &config.OTLPEndpoint)
+	text("LLM_OTLP_FILE", &config.OTLPFile)
+	text("LLM_TRACE_FILE", &config.TraceFile)
+	text("LLM_MCP_CONFIG", &config.MCPConfig)
+
+	flag("LLM_DEBUG_CHAT", &config.DebugChat)
+	flag("LLM_DEBUG_PIPELINE", &config.DebugPipeline)
+	flag("LLM_DEBUG_FAIL_EXIT", &config.DebugFailExit)
+	return config
+}
+
+// FromEnvironment builds the config from the LLM_* environment variables.
+func FromEnvironment() Config {
+	return environment(initial())
+}
+
+// ConfigFile returns the location of the config file, i.e. query-llm/config.yaml
+// under $XDG_CONFIG_HOME, or else under ~/.config.
+func ConfigFile() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "query-llm", "config.yaml")
+}
+
+// Load builds the config from the named profile in the config file, overridden by the LLM_* environment variables.
+// Without a name, the profile marked as default in the config file is used, if any.
+func Load(name string) (Config, error) {
+	config, err := resolve(name)
+	if err != nil {
+		return config, err
+	}
+	return environment(config), nil
+}
+
+// resolve builds the config from the named profile (or the default one), without the environment variables.
+func resolve(name string) (Config, error) {
+	config := initial()
+	filename := ConfigFile()
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) && name == "" {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	document, err := unYAML(string(data))
+	if err != nil {
+		return config, fmt.Errorf("%s: %w", filename, err)
+	}
+	var settings struct {
+		Default  string             `json:"default"`
+		Profiles map[string]Profile `json:"profiles"`
+	}
+	jsonData, _ := json.Marshal(document)
+	if err := json.Unmarshal(jsonData, &settings); err != nil {
+		return config, fmt.Errorf("%s: %w", filename, err)
+	}
+	if name == "" {
+		name = settings.Default
+	}
+	if name == "" {
+		return config, nil
+	}
+	profile, found := settings.Profiles[name]
+	if !found {
+		var names []string
+		for key := range settings.Profiles {
+			names = append(names, key)
+		}
+		sort.Strings(names)
+		return config, fmt.Errorf("profile %q is not found in %s (available: %s)", name, filename, strings.Join(names, ", "))
+	}
+
+	// key returns the API key, either as is or from the output of its command.
+	key := func(profile Profile) (string, error) {
+		if profile.APIKeyCommand == "" {
+			return profile.APIKey, nil
+		}
+		output, err := exec.Command("sh", "-c", profile.APIKeyCommand).Output()
+		if err != nil {
+			return "", fmt.Errorf("api_key_command of profile %q: %w", name, err)
+		}
+		return strings.TrimSpace(string(output)), nil
+	}
+
+	config.Profile = name
+	if profile.BaseURL != "" {
+		config.BaseURL = profile.BaseURL
+	}
+	apiKey, err := key(profile)
+	if err != nil {
+		return config, err
+	}
+	if apiKey != "" {
+		config.APIKey = apiKey
+	}
+	if profile.Model != "" {
+		config.ChatModel = profile.Model
+	}
+	if profile.EmbeddingModel != "" {
+		config.EmbeddingModel = profile.EmbeddingModel
+	}
+	if profile.Streaming != nil {
+		config.Streaming = *profile.Streaming
+	}
+	if profile.JSONSchema != nil {
+		config.JSONSchema = *profile.JSONSchema
+	}
+	switch profile.Pipeline {
+	case "":
+	case "zero-shot":
+		config.ZeroShot = true
+	case "chain-of-thought":
+		config.ZeroShot = false
+	default:
+		return config, fmt.Errorf("unknown pipeline %q of profile %q (must be zero-shot or chain-of-thought)", profile.Pipeline, name)
+	}
+	if profile.PromptDir != "" {
+		config.PromptDir = profile.PromptDir
+	}
+	if profile.ExampleFile != "" {
+		config.ExampleFile = profile.ExampleFile
+	}
+	if profile.ExampleCount > 0 {
+		config.ExampleCount = profile.ExampleCount
+	}
+	if profile.ExampleMatch != "" {
+		config.ExampleMatch = profile.ExampleMatch
+	}
+	if profile.Language != "" {
+		config.Language = profile.Language
+	}
+	if len(profile.Stages) > 0 {
+		config.Stages = make(map[string]Override)
+	}
+	for stage, override := range profile.Stages {
+		apiKey, err := key(override)
+		if err != nil {
+			return config, err
+		}
+		config.Stages[strings.ToLower(stage)] = Override{BaseURL: override.BaseURL, APIKey: apiKey, ChatModel: override.Model}
+	}
+	return config, nil
+}
+
+// Client runs the pipeline, and everything built on top of it, using the LLM service described by its config.
+type Client struct {
+	Config
+	Output io.Writer // where the progress and the debugging information are printed, nothing by default
+	*resources
+}
+
+// resources are loaded lazily, once, and shared by the clients derived from the same client (see adapt).
+type resources struct {
+	prices struct {
+		sync.Once
+		table map[string]Price
+	}
+	toolbox struct {
+		sync.Once
+		tools []Tool
+		stops []func()
+	}
+	templates struct {
+		sync.Once
+		prompts map[string]Prompt
+		err     error
+	}
+	library struct {
+		sync.Once
+		examples []Example
+		vectors  [][]float64
+		err      error
+	}
+}
+
+// NewClient creates a client for the LLM service described by the config.
+func NewClient(config Config) *Client {
+	return &Client{Config: config, Output: io.Discard, resources: &resources{}}
+}
+
+// adapt returns a client for a variation of the config, e.g. another chat model, sharing the loaded resources.
+func (client *Client) adapt(config Config) *Client {
+	return &Client{Config: config, Output: client.Output, resources: client.resources}
+}
+
+// stage returns the client for the named pipeline stage, with its overrides from the config applied.
+func (client *Client) stage(name string) *Client {
+	override, found := client.Stages[strings.ToLower(name)]
+	if !found {
+		return client
+	}
+	config := client.Config
+	if override.BaseURL != "" {
+		config.BaseURL = override.BaseURL
+	}
+	if override.APIKey != "" {
+		config.APIKey = override.APIKey
+	}
+	if override.ChatModel != "" {
+		config.ChatModel = override.ChatModel
+	}
+	return client.adapt(config)
+}
+
+// Pipeline transforms the context, e.g. by running one or more stages such as reason and respond.
+type Pipeline func(Context) (*Context, error)
+
 type Message struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
@@ -159,6 +602,11 @@ type ChatRequest struct {
 	MaxTokens      int                    `json:"max_tokens"`
 	Temperature    float64                `json:"temperature"`
 	Stream         bool                   `json:"stream"`
+	StreamOptions  *StreamOptions         `json:"stream_options,omitempty"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type ChatRequestGemini struct {
@@ -184,8 +632,21 @@ type GeminiGenerationConfig struct {
 }
 
 type ResponseData struct {
-	Choices    []Choice    `json:"choices"`
-	Candidates []Candidate `json:"candidates"`
+	Choices       []Choice       `json:"choices"`
+	Candidates    []Candidate    `json:"candidates"`
+	Usage         *Usage         `json:"usage"`
+	UsageMetadata *UsageMetadata `json:"usageMetadata"`
+}
+
+// Usage represents the number of tokens consumed by a chat completion.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+type UsageMetadata struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
 }
 
 type Choice struct {
@@ -201,6 +662,29 @@ type Candidate struct {
 	Content GeminiContent `json:"content"`
 }
 
+type EmbeddingRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type EmbeddingRequestGemini struct {
+	Requests []GeminiEmbeddingRequest `json:"requests"`
+}
+
+type GeminiEmbeddingRequest struct {
+	Model   string        `json:"model"`
+	Content GeminiContent `json:"content"`
+}
+
+type EmbeddingResponseData struct {
+	Data []struct {
+		Embedding []float64 `json:"embedding"`
+	} `json:"data"`
+	Embeddings []struct {
+		Values []float64 `json:"values"`
+	} `json:"embeddings"`
+}
+
 type Context struct {
 	History     []History
 	Inquiry     string
@@ -209,7 +693,39 @@ type Context struct {
 	Topic       string
 	Observation string
 	Answer      string
+	Language    string
 	Delegates   Delegates
+
+	// Scope cancels the requests to the LLM once done, e.g. on a timeout. Nil means never.
+	Scope gocontext.Context
+}
+
+// Streamer parses a JSON object incrementally, as its text arrives in chunks (e.g. as a chat handler),
+// and emits the new portion of every string value as soon as it is known. The value is identified by
+// its path, e.g. "answer", "user.name" for a nested object, or "tags.0" for an array element.
+type Streamer struct {
+	Emit func(path, fragment string)
+
+	stack   []frame
+	values  map[string]string
+	path    string
+	key     []byte
+	pending []byte
+
+	quoted    bool // inside a string
+	naming    bool // the string is a key
+	scalar    bool // inside a number, true, false, or null
+	escape    int  // 1 after a backslash, 2 or more inside a unicode escape
+	hex       []byte
+	surrogate rune
+}
+
+// frame is an object or an array being parsed by the streamer.
+type frame struct {
+	array bool
+	key   string
+	index int
+	state int
 }
 
 type History struct {
@@ -224,17 +740,150 @@ type History struct {
 }
 
 type Delegates struct {
-	Enter  func(string)
-	Leave  func(string, map[string]interface{})
-	Stream func(string)
+	Enter    func(string)
+	Leave    func(string, map[string]interface{})
+	Stream   func(string)
+	Revise   func(string) // replaces the streamed answer, once repaired (see conform)
+	Exchange func(Exchange)
+}
+
+// Exchange represents a chat completion request sent to the LLM, along with its outcome.
+type Exchange struct {
+	Model      string
+	Messages   []Message
+	Schema     map[string]interface{}
+	Completion string
+	Usage      Usage
+	Start      time.Time
+	Duration   time.Duration
+	Error      error
+}
+
+// Record represents an entry of the trace log (see Config.TraceFile), either for a turn
+// or for one of its exchanges with the LLM, including every retry.
+type Record struct {
+	Type             string                 `json:"type"`
+	Turn             string                 `json:"turn"`
+	Time             string                 `json:"time"`
+	File             string                 `json:"file,omitempty"`
+	Story            string                 `json:"story,omitempty"`
+	Inquiry          string                 `json:"inquiry"`
+	Model            string                 `json:"model"`
+	Stage            string                 `json:"stage,omitempty"`
+	Attempt          int                    `json:"attempt,omitempty"`
+	Messages         []Message              `json:"messages,omitempty"`
+	Schema           map[string]interface{} `json:"schema,omitempty"`
+	Completion       string                 `json:"completion,omitempty"`
+	Breakdown        map[string]string      `json:"breakdown,omitempty"`
+	Answer           string                 `json:"answer,omitempty"`
+	Stages           []Stage                `json:"stages,omitempty"`
+	PromptTokens     int                    `json:"prompt_tokens"`
+	CompletionTokens int                    `json:"completion_tokens"`
+	Duration         int64                  `json:"duration_ms"`
+	Error            string                 `json:"error,omitempty"`
+	Passed           *bool                  `json:"passed,omitempty"`
+	Failures         []string               `json:"failures,omitempty"`
+}
+
+// OTLPSpan represents a span in the OTLP/JSON encoding of OpenTelemetry.
+type OTLPSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []OTLPAttribute `json:"attributes,omitempty"`
+	Status            OTLPStatus      `json:"status"`
+}
+
+type OTLPAttribute struct {
+	Key   string    `json:"key"`
+	Value OTLPValue `json:"value"`
+}
+
+type OTLPValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type OTLPStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
 }
 
 // Stage represents the record of an atomic processing.
 type Stage struct {
-	Name      string
-	Timestamp int64
-	Duration  int64
-	Fields    map[string]interface{}
+	Name      string                 `json:"name"`
+	Timestamp int64                  `json:"timestamp"`
+	Duration  int64                  `json:"duration,omitempty"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+}
+
+// MCPServer represents how to launch an MCP server, as listed in the mcpServers section of the config.
+type MCPServer struct {
+	Command string            `json:"command"`
+	Args    []string          `json:"args"`
+	Env     map[string]string `json:"env"`
+}
+
+// Tool represents a tool offered by an MCP server.
+type Tool struct {
+	Server      string                                                 `json:"-"`
+	Name        string                                                 `json:"name"`
+	Description string                                                 `json:"description"`
+	InputSchema map[string]interface{}                                 `json:"inputSchema"`
+	Call        func(arguments map[string]interface{}) (string, error) `json:"-"`
+}
+
+// Setting is the data available to the prompt templates.
+type Setting struct {
+	Inquiry    string
+	History    []History // the recent turns considered by the stage
+	Topic      string    // the topic of the inquiry, or of the last turn before the reasoning
+	Date       string    // today, as YYYY-MM-DD
+	Locale     string    // e.g. en_US, from LC_ALL, LC_MESSAGES, or LANG
+	JSONSchema bool
+	Tools      []Tool
+	Examples   []Example // the few-shot examples given to the reasoning, if any
+	Language   string    // of the answer, with Config.Language
+}
+
+// Prompt is a template of a system prompt, along with the name of its schema from the front matter:
+// one of SCHEMAS, a JSON file relative to Config.PromptDir, or none.
+type Prompt struct {
+	Name     string
+	Schema   string
+	Template *txttemplate.Template
+
+	shape map[string]interface{}
+}
+
+// Language is a language known to the detector.
+type Language struct {
+	Code   string
+	Name   string
+	Sample string
+}
+
+// Example is a worked example of the reasoning, given as a prior turn when relevant to the inquiry.
+type Example struct {
+	Inquiry     string `json:"inquiry"`
+	Tool        string `json:"tool"`
+	Arguments   string `json:"arguments"`
+	Thought     string `json:"thought"`
+	Keyphrases  string `json:"keyphrases"`
+	Observation string `json:"observation"`
+	Topic       string `json:"topic"`
+}
+
+// Price represents the cost of a model, in USD per million tokens.
+type Price struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
 }
 
 // Span represents a match span with index and length.
@@ -243,29 +892,261 @@ type Span struct {
 	Length int
 }
 
+// Verdict represents the outcome of checking an actual value against an expectation.
+type Verdict struct {
+	Passed      bool
+	Expectation string
+	Actual      string
+}
+
+// Assertion represents an expectation on the most recent turn, e.g. "Assistant: /Jupiter/".
+type Assertion struct {
+	Role     string
+	Expected string
+}
+
+// Assertions is a list of assertions, decoded from a JSON object mapping every role to
+// either one or several expectations, e.g. {"Assistant": "/Jupiter/", "Assistant.Not": ["/sorry/"]}.
+type Assertions []Assertion
+
+// Turn represents an inquiry from the user, followed by the assertions on its outcome.
+// A silent turn is run only to build the history for the subsequent turns.
+type Turn struct {
+	Inquiry    string     `json:"user"`
+	Assertions Assertions `json:"assert"`
+	Silent     bool       `json:"-"`
+	Index      int        `json:"-"` // the position in the story, before any filtering
+}
+
+// Story represents a conversation, i.e. a series of turns sharing the same history.
+// Optionally, it can override the model, the pipeline ("zero-shot" or "chain-of-thought"),
+// and the timeout of every turn (e.g. "30s").
+type Story struct {
+	Name     string            `json:"story"`
+	Tags     []string          `json:"tags"`
+	Model    string            `json:"model"`
+	Pipeline string            `json:"pipeline"`
+	Language string            `json:"language"`
+	Timeout  string            `json:"timeout"`
+	Metadata map[string]string `json:"metadata"`
+	Turns    []Turn            `json:"turns"`
+	Index    int               `json:"-"` // the position in the test file, before any filtering
+}
+
+// Filter selects the stories and the turns to be evaluated.
+type Filter struct {
+	Story  *regexp.Regexp
+	Grep   *regexp.Regexp
+	Tags   []string
+	Failed map[string]bool
+}
+
+// Outcome represents the result of a single run of a turn.
+type Outcome struct {
+	Model            string   `json:"model,omitempty"`
+	Answer           string   `json:"answer"`
+	Keyphrases       string   `json:"keyphrases,omitempty"`
+	Topic            string   `json:"topic,omitempty"`
+	Duration         int64    `json:"duration"`
+	PromptTokens     int      `json:"prompt_tokens"`
+	CompletionTokens int      `json:"completion_tokens"`
+	Passed           bool     `json:"passed"`
+	Failures         []string `json:"failures,omitempty"`
+	Stages           []Stage  `json:"-"`
+	Exchanges        []Record `json:"-"`
+	Checks           []Check  `json:"-"`
+}
+
+// Check represents the verdict of an assertion on a turn.
+type Check struct {
+	Role string
+	Verdict
+}
+
+// Question aggregates the outcomes of every run of the same inquiry.
+type Question struct {
+	File       string            `json:"file"`
+	Story      string            `json:"story,omitempty"`
+	StoryIndex int               `json:"story_index"`
+	TurnIndex  int               `json:"turn_index"`
+	Tags       []string          `json:"tags,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	Inquiry    string            `json:"inquiry"`
+	Passes     int               `json:"passes"`
+	Runs       int               `json:"runs"`
+	PassRate   float64           `json:"pass_rate"`
+	Status     string            `json:"status"`
+	Outcomes   []Outcome         `json:"outcomes"`
+}
+
+// Snapshot represents the recorded outcome of an inquiry, serving as a baseline.
+type Snapshot struct {
+	File       string `json:"file"`
+	Story      string `json:"story,omitempty"`
+	StoryIndex int    `json:"story_index"`
+	TurnIndex  int    `json:"turn_index"`
+	Inquiry    string `json:"inquiry"`
+	Answer     string `json:"answer"`
+	Keyphrases string `json:"keyphrases,omitempty"`
+	Topic      string `json:"topic,omitempty"`
+	Passed     bool   `json:"passed"`
+	Duration   int64  `json:"duration"`
+}
+
+// Report represents the JSON report of an evaluation.
+type Report struct {
+	BaseURL          string     `json:"base_url"`
+	Model            string     `json:"model"`
+	Repeat           int        `json:"repeat"`
+	Total            int        `json:"total"`
+	Passed           int        `json:"passed"`
+	Flaky            int        `json:"flaky"`
+	Failing          int        `json:"failing"`
+	PassAt1          float64    `json:"pass_at_1"`
+	PassAtK          float64    `json:"pass_at_k"`
+	MedianLatency    int64      `json:"median_latency"`
+	P95Latency       int64      `json:"p95_latency"`
+	PromptTokens     int        `json:"prompt_tokens"`
+	CompletionTokens int        `json:"completion_tokens"`
+	Cost             float64    `json:"cost,omitempty"`
+	Questions        []Question `json:"questions"`
+}
+
 // review prints the pipeline stages, mostly for troubleshooting.
-func review(stages []Stage) {
-	fmt.Println()
-	fmt.Println("Pipeline review")
-	fmt.Println("---------------")
+func (client *Client) review(stages []Stage) {
+	fmt.Fprintln(client.Output)
+	fmt.Fprintln(client.Output, "Pipeline review")
+	fmt.Fprintln(client.Output, "---------------")
 	for index, stage := range stages {
-		fmt.Printf("Stage #%d %s [%d ms]\n", index+1, stage.Name, stage.Duration)
-		for key, value := range stage.Fields {
-			fmt.Printf("%s: %v\n", key, value)
+		fmt.Fprintf(client.Output, "Stage #%d %s [%d ms]\n", index+1, stage.Name, stage.Duration)
+		for _, key := range arrange(stage.Fields) {
+			fmt.Fprintf(client.Output, "%s: %v\n", key, stage.Fields[key])
+		}
+	}
+	if usage := consumption(stages); usage.PromptTokens+usage.CompletionTokens > 0 {
+		fmt.Fprintf(client.Output, "Tokens: %s\n", client.expense(usage, client.ChatModel, nil))
+	}
+	fmt.Fprintln(client.Output)
+}
+
+// arrange returns the keys of the stage fields, the predefined ones first, to keep a stable order.
+func arrange(fields map[string]interface{}) []string {
+	var keys []string
+	for _, key := range TOOL_KEYS {
+		if _, exists := fields[key]; exists {
+			keys = append(keys, key)
+		}
+	}
+	var others []string
+	for key := range fields {
+		if !contains(TOOL_KEYS, key) {
+			others = append(others, key)
+		}
+	}
+	sort.Strings(others)
+	return append(keys, others...)
+}
+
+// contains checks whether the list includes the item.
+func contains(list []string, item string) bool {
+	for _, element := range list {
+		if element == item {
+			return true
+		}
+	}
+	return false
+}
+
+// consumption sums the tokens recorded by every stage.
+func consumption(stages []Stage) Usage {
+	count := func(value interface{}) int {
+		switch number := value.(type) {
+		case int:
+			return number
+		case float64:
+			return int(number)
+		}
+		return 0
+	}
+	var usage Usage
+	for _, stage := range stages {
+		usage.PromptTokens += count(stage.Fields["prompt_tokens"])
+		usage.CompletionTokens += count(stage.Fields["completion_tokens"])
+	}
+	return usage
+}
+
+// answering returns the tokens consumed by the stage which produced the answer.
+func answering(stages []Stage) Usage {
+	var usage Usage
+	for _, stage := range stages {
+		if _, exists := stage.Fields["answer"]; exists {
+			usage = consumption([]Stage{stage})
+		}
+	}
+	return usage
+}
+
+// cost converts the token usage into its cost (in USD) using the price table of Config.PriceTable,
+// a JSON file mapping every model to its prompt and completion prices per million tokens, e.g.
+// {"gpt-4o-mini": {"prompt": 0.15, "completion": 0.6}}.
+func (client *Client) cost(model string, usage Usage) (float64, bool) {
+	client.prices.Do(func() {
+		if client.PriceTable == "" {
+			return
+		}
+		jsonData, err := os.ReadFile(client.PriceTable)
+		if err == nil {
+			err = json.Unmarshal(jsonData, &client.prices.table)
 		}
+		if err != nil {
+			fmt.Fprintln(client.Output, "ERROR: unable to load the price table:", err)
+		}
+	})
+	price, exists := client.prices.table[model]
+	if !exists {
+		return 0, false
+	}
+	return (float64(usage.PromptTokens)*price.Prompt + float64(usage.CompletionTokens)*price.Completion) / 1e6, true
+}
+
+// expense describes the token usage, along with its cost if the price of the model is known.
+// With the exchanges behind the usage, each one is priced by its own model instead, since a story
+// or a stage (see Config.Stages) may use another model, and the cost is known only if every price is.
+func (client *Client) expense(usage Usage, model string, exchanges []Record) string {
+	description := fmt.Sprintf("%d prompt + %d completion", usage.PromptTokens, usage.CompletionTokens)
+	amount, known := client.cost(model, usage)
+	if len(exchanges) > 0 {
+		amount, known = 0, true
+		for _, exchange := range exchanges {
+			price, exists := client.cost(exchange.Model, Usage{exchange.PromptTokens, exchange.CompletionTokens})
+			amount += price
+			known = known && exists
+		}
+	}
+	if known {
+		description += fmt.Sprintf(" ($%.6f)", amount)
 	}
-	fmt.Println()
+	return description
+}
+
+// markers returns the predefined keys, along with the arguments of the tool if there are tools from MCP servers.
+func (client *Client) markers() []string {
+	if len(client.equip()) > 0 {
+		return TOOL_KEYS
+	}
+	return PREDEFINED_KEYS
 }
 
 // construct constructs a multi-line text based on a number of key-value pairs.
-func construct(kv map[string]string) string {
-	if LLMJsonSchema != "" {
+func (client *Client) construct(kv map[string]string) string {
+	if client.JSONSchema {
 		jsonData, _ := json.MarshalIndent(kv, "", "  ")
 		return string(jsonData)
 	}
 
 	var result []string
-	for _, key := range PREDEFINED_KEYS {
+	for _, key := range client.markers() {
 		if value, exists := kv[key]; exists && len(value) > 0 {
 			result = append(result, key+": "+value)
 		}
@@ -274,12 +1155,13 @@ func construct(kv map[string]string) string {
 }
 
 // breakdown breaks down the completion into a dictionary containing the thought process, important keyphrases, observation, and topic.
-func breakdown(hint, completion string) map[string]string {
+// It also returns the flaws of the completion which had to be patched, e.g. invalid JSON or a missing topic.
+func (client *Client) breakdown(hint, completion string) (map[string]string, []string) {
 
 	// Deconstruct breaks down a multi-line text based on a number of predefined keys.
 	deconstruct := func(text string, markers []string) map[string]string {
 		if markers == nil {
-			markers = PREDEFINED_KEYS
+			markers = client.markers()
 		}
 
 		reverse := func(s []string) {
@@ -318,35 +1200,24 @@ func breakdown(hint, completion string) map[string]string {
 		return converted
 	}
 
+	var flaws []string
 	text := hint + completion
 	if strings.HasPrefix(text, "{") {
-		result := unJSON(text)
-		if result != nil {
-			return convertMap(result)
+		// unJSON gives an empty object for an invalid JSON
+		if result := unJSON(text); len(result) > 0 {
+			return convertMap(result), nil
 		}
-		if LLMDebugChat != "" {
-			fmt.Printf("Failed to parse JSON: %s\n", strings.ReplaceAll(text, "\n", ""))
+		if client.DebugChat {
+			fmt.Fprintf(client.Output, "Failed to parse JSON: %s\n", strings.ReplaceAll(text, "\n", ""))
 		}
+		flaws = append(flaws, "$: not valid JSON, parsed as text")
 	}
 	result := deconstruct(text, nil)
 	if topic, exists := result["topic"]; !exists || len(topic) == 0 {
 		result = deconstruct(text+"\n"+"TOPIC: general knowledge.", nil)
+		flaws = append(flaws, "topic: missing")
 	}
-	return result
-}
-
-// structure returns a formatted string based on the given object.
-func structure(prefix string, object map[string]string) string {
-	if LLMJsonSchema != "" {
-		format := prefix
-		if prefix != "" {
-			format += " (JSON with this schema)"
-		}
-		jsonData, _ := json.MarshalIndent(object, "", "  ")
-		return format + "\n" + string(jsonData) + "\n"
-	}
-
-	return prefix + "\n\n" + construct(object) + "\n"
+	return result, flaws
 }
 
 // simplify collapses every pair of stages (enter and leave) into one stage,
@@ -387,7 +1258,7 @@ func regexify(match string) []*regexp.Regexp {
 
 	pattern := func(text string, index int) int {
 		i := index
-		if text[i] == '/' {
+		if i < len(text) && text[i] == '/' {
 			i++
 			for i < len(text) {
 				if text[i] == '/' && text[i-1] != '\\' {
@@ -456,14 +1327,317 @@ func highlight(text string, spans []Span, color string) string {
 	return result
 }
 
-// pipe creates a new function by chaining multiple functions from left to right.
-func pipe(fns ...func(ctx Context) (*Context, error)) func(ctx Context) (*Context, error) {
-	return func(ctx Context) (*Context, error) {
-		var err error
-		result := &ctx
-		for _, fn := range fns {
-			result, err = fn(*result)
-			if err != nil {
+// words returns the number of words in the text.
+func words(text string) int {
+	return len(strings.Fields(text))
+}
+
+// sentences returns the number of sentences in the text.
+func sentences(text string) int {
+	count := 0
+	for _, part := range regexp.MustCompile(`[.!?]+(\s+|$)`).Split(text, -1) {
+		if len(strings.TrimSpace(part)) > 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// tokens approximates the number of tokens in the text: every word counts as one token
+// for every (started) 6 letters, every number as one token for every 3 digits, and every
+// other symbol as one token.
+func tokens(text string) int {
+	count := 0
+	for _, piece := range regexp.MustCompile(`\p{L}+|\p{N}+|[^\p{L}\p{N}\s]`).FindAllString(text, -1) {
+		length := len([]rune(piece))
+		if unicode.IsLetter([]rune(piece)[0]) {
+			count += (length + 5) / 6
+		} else if unicode.IsNumber([]rune(piece)[0]) {
+			count += (length + 2) / 3
+		} else {
+			count++
+		}
+	}
+	return count
+}
+
+// latency checks the duration (in milliseconds) against the maximum, e.g. "3000ms" or "3s".
+// A number without any unit is in milliseconds.
+func latency(duration int64, expected string) (Verdict, error) {
+	text := strings.TrimSpace(expected)
+	if _, err := strconv.ParseFloat(text, 64); err == nil {
+		text += "ms"
+	}
+	maximum, err := time.ParseDuration(text)
+	if err != nil {
+		return Verdict{}, fmt.Errorf("invalid latency: %s", expected)
+	}
+	limit := maximum.Milliseconds()
+	if duration <= limit {
+		return Verdict{Passed: true, Actual: fmt.Sprintf("%s%d ms%s %s<= %d ms%s", GREEN, duration, NORMAL, GRAY, limit, NORMAL)}, nil
+	}
+	return Verdict{
+		Expectation: fmt.Sprintf("to take at most %s%d ms%s", CYAN, limit, NORMAL),
+		Actual:      fmt.Sprintf("%s%d ms%s", MAGENTA, duration, NORMAL),
+	}, nil
+}
+
+// occurrences returns every match (not only the first one) given a list of regular expressions.
+func occurrences(text string, regexes []*regexp.Regexp) []Span {
+	var spans []Span
+	for _, regex := range regexes {
+		for _, matches := range regex.FindAllStringIndex(text, -1) {
+			spans = append(spans, Span{
+				Index:  matches[0],
+				Length: matches[1] - matches[0],
+			})
+		}
+	}
+	return spans
+}
+
+// quantify checks a measured value of the target against the criterion, e.g. "<= 3".
+func quantify(value int, name, target, expected string) (Verdict, error) {
+	_, operator, limit, ok := criterion(expected)
+	if !ok {
+		return Verdict{}, fmt.Errorf("invalid criterion for %s: %s", name, expected)
+	}
+	passed := compare(float64(value), operator, limit)
+	color := GREEN
+	if !passed {
+		color = MAGENTA
+	}
+	return Verdict{
+		Passed:      passed,
+		Expectation: fmt.Sprintf("to have %s%s %g%s %s", CYAN, operator, limit, NORMAL, name),
+		Actual:      fmt.Sprintf("%s%d %s%s in %s", color, value, name, NORMAL, target),
+	}, nil
+}
+
+// verify checks the target against the expected content, using the specified matcher:
+//   - (none): every regex must match, e.g. "The answer is /Jupiter/."
+//   - Not: none of the regexes may match, e.g. "/sorry|apolog/"
+//   - Count: the number of matches, e.g. "/Newton|Leibniz/ == 2"
+//   - Words: the number of words, e.g. "<= 50"
+//   - Sentences: the number of sentences, e.g. "<= 3"
+//   - MaxTokens: the maximum number of tokens, estimated from the text, e.g. "80"
+//   - Similar: the semantic similarity, e.g. "Jupiter is the largest planet >= 0.85"
+func (client *Client) verify(matcher, target, expected string) (Verdict, error) {
+	measure := func(name string, count func(string) int) (Verdict, error) {
+		return quantify(count(target), name, target, expected)
+	}
+
+	switch matcher {
+	case "":
+		regexes := regexify(expected)
+		matches := match(target, regexes)
+		if len(matches) == len(regexes) {
+			return Verdict{Passed: true, Actual: highlight(target, matches, GREEN)}, nil
+		}
+		return Verdict{
+			Expectation: fmt.Sprintf("to contain: %s%s%s", CYAN, regexes, NORMAL),
+			Actual:      fmt.Sprintf("%s%s%s", MAGENTA, target, NORMAL),
+		}, nil
+
+	case "Not":
+		regexes := regexify(expected)
+		matches := match(target, regexes)
+		if len(matches) == 0 {
+			return Verdict{Passed: true, Actual: target}, nil
+		}
+		return Verdict{
+			Expectation: fmt.Sprintf("to not contain: %s%s%s", CYAN, regexes, NORMAL),
+			Actual:      highlight(target, matches, RED),
+		}, nil
+
+	case "Count":
+		subject, operator, limit, ok := criterion(expected)
+		if !ok {
+			return Verdict{}, fmt.Errorf("invalid criterion for %s: %s", matcher, expected)
+		}
+		regexes := regexify(subject)
+		spans := occurrences(target, regexes)
+		passed := compare(float64(len(spans)), operator, limit)
+		color := GREEN
+		if !passed {
+			color = RED
+		}
+		return Verdict{
+			Passed:      passed,
+			Expectation: fmt.Sprintf("to match %s %s%s %g%s time(s)", regexes, CYAN, operator, limit, NORMAL),
+			Actual:      fmt.Sprintf("%s%d%s match(es) in %s", color, len(spans), NORMAL, highlight(target, spans, color)),
+		}, nil
+
+	case "Words":
+		return measure("word(s)", words)
+
+	case "Sentences":
+		return measure("sentence(s)", sentences)
+
+	case "MaxTokens":
+		expected = "<= " + strings.TrimSpace(expected)
+		return measure("estimated token(s)", tokens)
+
+	case "Similar":
+		reference, operator, limit, ok := criterion(expected)
+		if !ok {
+			operator, limit = ">=", SIMILARITY_THRESHOLD
+		}
+		score, err := client.similarity(target, reference)
+		if err != nil {
+			return Verdict{}, err
+		}
+		if compare(score, operator, limit) {
+			return Verdict{
+				Passed: true,
+				Actual: fmt.Sprintf("%s%.2f%s %s %.2f%s", GREEN, score, GRAY, operator, limit, NORMAL),
+			}, nil
+		}
+		return Verdict{
+			Expectation: fmt.Sprintf("to score %s %.2f against: %s%s%s", operator, limit, CYAN, reference, NORMAL),
+			Actual:      fmt.Sprintf("%s%.2f%s for %s", MAGENTA, score, NORMAL, target),
+		}, nil
+	}
+
+	return Verdict{}, fmt.Errorf("unknown matcher: %s", matcher)
+}
+
+// inspect looks up the field recorded by the most recent stage of the given name.
+// Both names are case-insensitive, and underscores in the field name are optional,
+// e.g. the field "keyphrases" of the stage "Reason" is found as Reason.Keyphrases.
+func inspect(stages []Stage, name, field string) (string, bool) {
+	for i := len(stages) - 1; i >= 0; i-- {
+		stage := stages[i]
+		if !strings.EqualFold(stage.Name, name) {
+			continue
+		}
+		for key, value := range stage.Fields {
+			if strings.EqualFold(strings.ReplaceAll(key, "_", ""), field) {
+				return fmt.Sprintf("%v", value), true
+			}
+		}
+	}
+	return "", false
+}
+
+// criterion splits a text such as "some reference >= 0.85" into the subject,
+// the comparison operator, and the numeric limit.
+func criterion(text string) (string, string, float64, bool) {
+	regex := regexp.MustCompile(`^(.*?)\s*(<=|>=|==|<|>)\s*(-?[0-9]*\.?[0-9]+)$`)
+	parts := regex.FindStringSubmatch(strings.TrimSpace(text))
+	if parts == nil {
+		return strings.TrimSpace(text), "", 0, false
+	}
+	var limit float64
+	fmt.Sscanf(parts[3], "%g", &limit)
+	return parts[1], parts[2], limit, true
+}
+
+// compare checks whether a value satisfies the comparison against the limit.
+func compare(value float64, operator string, limit float64) bool {
+	switch operator {
+	case "<=":
+		return value <= limit
+	case ">=":
+		return value >= limit
+	case "==":
+		return value == limit
+	case "<":
+		return value < limit
+	case ">":
+		return value > limit
+	}
+	return false
+}
+
+// cosine computes the cosine similarity of two vectors.
+func cosine(a, b []float64) float64 {
+	if len(a) == 0 || len(a) != len(b) {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// similarity computes the semantic similarity between two texts using their embeddings.
+func (client *Client) similarity(text, reference string) (float64, error) {
+	vectors, err := client.embed(nil, []string{text, reference})
+	if err != nil {
+		return 0, err
+	}
+	return cosine(vectors[0], vectors[1]), nil
+}
+
+// plain strips the ANSI colors from the text.
+func plain(text string) string {
+	return regexp.MustCompile("\x1b\\[[0-9;]*m").ReplaceAllString(text, "")
+}
+
+// trigrams counts the character trigrams of the text, with every word padded by spaces.
+func trigrams(text string) map[string]float64 {
+	counts := make(map[string]float64)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	}) {
+		runes := []rune(" " + word + " ")
+		for i := 0; i+3 <= len(runes); i++ {
+			counts[string(runes[i:i+3])]++
+		}
+	}
+	return counts
+}
+
+// Recognize detects the language of the text by comparing its trigrams against the profile of every one
+// of LANGUAGES, and returns its name along with the similarity. The name is empty when unsure, e.g. for a single word.
+func Recognize(text string) (string, float64) {
+	profiles.Do(func() {
+		profiles.table = make(map[string]map[string]float64)
+		for _, language := range LANGUAGES {
+			profiles.table[language.Name] = trigrams(language.Sample)
+		}
+	})
+
+	target := trigrams(text)
+	best, score := "", 0.0
+	for _, language := range LANGUAGES {
+		profile := profiles.table[language.Name]
+		dot, a, b := 0.0, 0.0, 0.0
+		for trigram, count := range target {
+			dot += count * profile[trigram]
+			a += count * count
+		}
+		for _, count := range profile {
+			b += count * count
+		}
+		if a == 0 || b == 0 {
+			continue
+		}
+		if similarity := dot / math.Sqrt(a*b); similarity > score {
+			best, score = language.Name, similarity
+		}
+	}
+	if score < LANGUAGE_THRESHOLD {
+		return "", score
+	}
+	return best, score
+}
+
+// Pipe creates a new function by chaining multiple functions from left to right.
+func Pipe(fns ...Pipeline) Pipeline {
+	return func(ctx Context) (*Context, error) {
+		var err error
+		result := &ctx
+		for _, fn := range fns {
+			result, err = fn(*result)
+			if err != nil {
 				return nil, err
 			}
 		}
@@ -492,12 +1666,357 @@ func unJSON(text string) map[string]interface{} {
 	return map[string]interface{}{}
 }
 
-func chat(
+// unYAML parses the subset of YAML used by the config file: nested mappings of scalars, with comments.
+// Unquoted true/false and yes/no become booleans, every other scalar stays a string.
+func unYAML(text string) (map[string]interface{}, error) {
+	type entry struct {
+		number int
+		indent int
+		key    string
+		value  interface{}
+		nested bool
+	}
+
+	// scalar converts the text after the colon, dropping any trailing comment.
+	scalar := func(text string) (interface{}, error) {
+		if strings.HasPrefix(text, "\"") || strings.HasPrefix(text, "'") {
+			quote := text[0]
+			for i := 1; i < len(text); i++ {
+				if quote == '"' && text[i] == '\\' {
+					i++
+					continue
+				}
+				if text[i] != quote {
+					continue
+				}
+				if quote == '\'' && i+1 < len(text) && text[i+1] == '\'' {
+					i++
+					continue
+				}
+				rest := strings.TrimSpace(text[i+1:])
+				if rest != "" && !strings.HasPrefix(rest, "#") {
+					return nil, fmt.Errorf("unexpected %q after the quoted value", rest)
+				}
+				if quote == '\'' {
+					return strings.ReplaceAll(text[1:i], "''", "'"), nil
+				}
+				return strconv.Unquote(text[:i+1])
+			}
+			return nil, fmt.Errorf("unterminated quoted value %s", text)
+		}
+		if index := strings.Index(text, " #"); index >= 0 {
+			text = strings.TrimSpace(text[:index])
+		}
+		switch strings.ToLower(text) {
+		case "true", "yes", "on":
+			return true, nil
+		case "false", "no", "off":
+			return false, nil
+		}
+		return text, nil
+	}
+
+	var entries []entry
+	for number, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		content := strings.TrimLeft(line, " ")
+		if content == "" || strings.HasPrefix(content, "#") || content == "---" {
+			continue
+		}
+		if strings.HasPrefix(content, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", number+1)
+		}
+		if content == "-" || strings.HasPrefix(content, "- ") {
+			return nil, fmt.Errorf("line %d: lists are not supported", number+1)
+		}
+		key, rest, found := strings.Cut(content, ":")
+		if !found || (rest != "" && rest[0] != ' ') {
+			return nil, fmt.Errorf("line %d: expecting key: value", number+1)
+		}
+		rest = strings.TrimSpace(rest)
+		current := entry{number: number + 1, indent: len(line) - len(content), key: strings.Trim(strings.TrimSpace(key), `"'`)}
+		if rest == "" || strings.HasPrefix(rest, "#") {
+			current.nested = true
+		} else {
+			value, err := scalar(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", number+1, err)
+			}
+			current.value = value
+		}
+		entries = append(entries, current)
+	}
+
+	// block collects the entries at the same indentation, starting from the given one, into a mapping.
+	var block func(start, indent int) (map[string]interface{}, int, error)
+	block = func(start, indent int) (map[string]interface{}, int, error) {
+		result := make(map[string]interface{})
+		i := start
+		for i < len(entries) && entries[i].indent >= indent {
+			current := entries[i]
+			if current.indent > indent {
+				return nil, i, fmt.Errorf("line %d: unexpected indentation", current.number)
+			}
+			i++
+			if !current.nested {
+				result[current.key] = current.value
+				continue
+			}
+			if i == len(entries) || entries[i].indent <= indent {
+				result[current.key] = nil
+				continue
+			}
+			child, next, err := block(i, entries[i].indent)
+			if err != nil {
+				return nil, next, err
+			}
+			result[current.key] = child
+			i = next
+		}
+		return result, i, nil
+	}
+
+	if len(entries) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	result, next, err := block(0, entries[0].indent)
+	if err == nil && next < len(entries) {
+		err = fmt.Errorf("line %d: unexpected indentation", entries[next].number)
+	}
+	return result, err
+}
+
+// NewStreamer creates a streamer which emits the fragments of every string value into the function.
+func NewStreamer(emit func(path, fragment string)) *Streamer {
+	return &Streamer{Emit: emit, values: make(map[string]string)}
+}
+
+// Write parses the next chunk of the text. Anything before the first object or array, such as
+// a Markdown fence, is skipped.
+func (streamer *Streamer) Write(text string) {
+	for i := 0; i < len(text); i++ {
+		streamer.step(text[i])
+	}
+	streamer.flush(false)
+}
+
+// Value returns the (partial) string value at the path.
+func (streamer *Streamer) Value(path string) string {
+	return streamer.values[path]
+}
+
+// step advances the parser by one byte.
+func (streamer *Streamer) step(c byte) {
+	if streamer.quoted {
+		streamer.character(c)
+		return
+	}
+	if len(streamer.stack) == 0 {
+		if c == '{' || c == '[' {
+			streamer.open(c)
+		}
+		return
+	}
+	top := &streamer.stack[len(streamer.stack)-1]
+	if streamer.scalar {
+		if !strings.ContainsRune(",]} \t\r\n", rune(c)) {
+			return
+		}
+		streamer.scalar = false
+	}
+	switch c {
+	case ' ', '\t', '\r', '\n':
+	case '"':
+		streamer.quoted = true
+		streamer.naming = !top.array && top.state == EXPECT_KEY
+		streamer.key = streamer.key[:0]
+		if !streamer.naming {
+			top.state = EXPECT_COMMA
+			var segments []string
+			for _, container := range streamer.stack {
+				if container.array {
+					segments = append(segments, strconv.Itoa(container.index))
+				} else {
+					segments = append(segments, container.key)
+				}
+			}
+			streamer.path = strings.Join(segments, ".")
+		}
+	case ':':
+		if top.state == EXPECT_COLON {
+			top.state = EXPECT_VALUE
+		}
+	case ',':
+		if top.array {
+			top.index++
+			top.state = EXPECT_VALUE
+		} else {
+			top.state = EXPECT_KEY
+		}
+	case '{', '[':
+		top.state = EXPECT_COMMA
+		streamer.open(c)
+	case '}', ']':
+		streamer.stack = streamer.stack[:len(streamer.stack)-1]
+	default:
+		top.state = EXPECT_COMMA
+		streamer.scalar = true
+	}
+}
+
+// open starts a nested object or array.
+func (streamer *Streamer) open(c byte) {
+	state := EXPECT_KEY
+	if c == '[' {
+		state = EXPECT_VALUE
+	}
+	streamer.stack = append(streamer.stack, frame{array: c == '[', state: state})
+}
+
+// character consumes one byte of a string, decoding the escape sequences.
+func (streamer *Streamer) character(c byte) {
+	switch {
+	case streamer.escape == 1:
+		streamer.escape = 0
+		replacements := map[byte]string{'"': "\"", '\\': "\\", '/': "/", 'b': "\b", 'f': "\f", 'n': "\n", 'r': "\r", 't': "\t"}
+		if c == 'u' {
+			streamer.escape = 2
+			streamer.hex = streamer.hex[:0]
+			return
+		}
+		if replacement, found := replacements[c]; found {
+			streamer.append(replacement)
+		}
+		return
+	case streamer.escape >= 2:
+		streamer.hex = append(streamer.hex, c)
+		if len(streamer.hex) < 4 {
+			return
+		}
+		streamer.escape = 0
+		code, err := strconv.ParseUint(string(streamer.hex), 16, 32)
+		if err != nil {
+			streamer.append(string(utf8.RuneError))
+			return
+		}
+		r := rune(code)
+		if utf16.IsSurrogate(r) && r < 0xdc00 {
+			// a previous high surrogate without its low surrogate is replaced
+			streamer.append("")
+			streamer.surrogate = r
+			return
+		}
+		if streamer.surrogate != 0 && utf16.IsSurrogate(r) {
+			r = utf16.DecodeRune(streamer.surrogate, r)
+			streamer.surrogate = 0
+		}
+		// otherwise, append replaces the pending high surrogate (if any) before the character
+		streamer.append(string(r))
+		return
+	case c == '\\':
+		streamer.escape = 1
+		return
+	case c == '"':
+		streamer.quoted = false
+		if streamer.surrogate != 0 {
+			streamer.append("")
+		}
+		if streamer.naming {
+			streamer.stack[len(streamer.stack)-1].key = string(streamer.key)
+			streamer.stack[len(streamer.stack)-1].state = EXPECT_COLON
+			return
+		}
+		streamer.flush(true)
+		return
+	}
+	streamer.append(string([]byte{c}))
+}
+
+// append adds the decoded text to the current key or string value.
+// A pending high surrogate without its low surrogate becomes a replacement character.
+func (streamer *Streamer) append(text string) {
+	if streamer.surrogate != 0 {
+		streamer.surrogate = 0
+		text = string(utf8.RuneError) + text
+	}
+	if streamer.naming {
+		streamer.key = append(streamer.key, text...)
+		return
+	}
+	streamer.pending = append(streamer.pending, text...)
+}
+
+// flush emits the pending fragment of the current string value. Unless the string is complete,
+// an incomplete UTF-8 sequence at its end is held back until the rest of it arrives.
+func (streamer *Streamer) flush(complete bool) {
+	size := len(streamer.pending)
+	if !complete {
+		for start := size - 1; start >= 0 && start >= size-utf8.UTFMax; start-- {
+			if utf8.RuneStart(streamer.pending[start]) {
+				if !utf8.FullRune(streamer.pending[start:]) {
+					size = start
+				}
+				break
+			}
+		}
+	}
+	if size == 0 {
+		return
+	}
+	fragment := string(streamer.pending[:size])
+	streamer.pending = append(streamer.pending[:0], streamer.pending[size:]...)
+	streamer.values[streamer.path] += fragment
+	if streamer.Emit != nil {
+		streamer.Emit(streamer.path, fragment)
+	}
+}
+
+// unwrap returns a stream delegate which forwards the answer to the handler as it is being streamed.
+// With Config.JSONSchema, the streamed completion is a JSON object, hence only the new portion
+// of its answer is forwarded, as parsed incrementally by a streamer.
+func (client *Client) unwrap(handler func(string)) func(string) {
+	streamer := NewStreamer(func(path, fragment string) {
+		if path == "answer" {
+			handler(fragment)
+		}
+	})
+	return func(text string) {
+		if !client.JSONSchema {
+			handler(text)
+			return
+		}
+		streamer.Write(text)
+	}
+}
+
+// Pipeline returns the configured pipeline: either reply (zero-shot), or reason followed by respond (chain-of-thought).
+func (client *Client) Pipeline() Pipeline {
+	return client.assemble(client.ZeroShot)
+}
+
+// assemble builds either the zero-shot or the chain-of-thought pipeline.
+// With Config.Language, the language is detected first.
+func (client *Client) assemble(zeroShot bool) Pipeline {
+	stages := []Pipeline{client.Reason, client.Respond}
+	if zeroShot {
+		stages = []Pipeline{client.Reply}
+	}
+	if client.Language != "" {
+		stages = append([]Pipeline{client.Detect}, stages...)
+	}
+	return Pipe(stages...)
+}
+
+// Chat sends the messages to the LLM and returns its completion, along with the token usage.
+// With a schema, the completion is constrained to JSON. With a handler, the completion is streamed into it.
+// Cancelling the scope aborts the request.
+func (client *Client) Chat(
+	scope gocontext.Context,
 	messages []Message,
 	schema map[string]interface{},
 	handler func(string),
 	maxRetryAttempt *int,
-) (string, error) {
+) (string, Usage, error) {
 	composeRequest := func(
 		messages []Message,
 		schema map[string]interface{},
@@ -513,15 +2032,15 @@ func chat(
 						return "generateContent?"
 					}
 				}()
-				return fmt.Sprintf("%s/models/%s:%skey=%s", LLMAPIBaseURL, LLMChatModel, generationType, LLMAPIKey)
+				return fmt.Sprintf("%s/models/%s:%skey=%s", client.BaseURL, client.ChatModel, generationType, client.APIKey)
 			}
-			return fmt.Sprintf("%s/chat/completions", LLMAPIBaseURL)
+			return fmt.Sprintf("%s/chat/completions", client.BaseURL)
 		}()
 		authHeader := func() string {
-			if LLMAPIKey == "" || isGemini {
+			if client.APIKey == "" || isGemini {
 				return ""
 			}
-			return fmt.Sprintf("Bearer %s", LLMAPIKey)
+			return fmt.Sprintf("Bearer %s", client.APIKey)
 		}()
 
 		requestBody := func() any {
@@ -591,20 +2110,27 @@ func chat(
 					},
 				}
 			}()
+			streamOptions := func() *StreamOptions {
+				if !isStreaming {
+					return nil
+				}
+				return &StreamOptions{IncludeUsage: true}
+			}()
 			return ChatRequest{
 				Messages:       messages,
 				ResponseFormat: responseFormat,
-				Model:          LLMChatModel,
+				Model:          client.ChatModel,
 				Stop:           []string{"<|im_end|>", "<|end|>", "<|eot_id|>"},
 				MaxTokens:      MAX_TOKENS,
 				Temperature:    TEMPERATURE,
 				Stream:         isStreaming,
+				StreamOptions:  streamOptions,
 			}
 		}()
 
-		if LLMDebugChat != "" {
+		if client.DebugChat {
 			for _, message := range messages {
-				fmt.Printf("%s%s:%s %s\n", MAGENTA, message.Role, NORMAL, message.Content)
+				fmt.Fprintf(client.Output, "%s%s:%s %s\n", MAGENTA, message.Role, NORMAL, message.Content)
 			}
 		}
 
@@ -612,7 +2138,7 @@ func chat(
 		if err != nil {
 			return nil, err
 		}
-		req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonBody))
+		req, err := http.NewRequestWithContext(scope, "POST", url, bytes.NewBuffer(jsonBody))
 		if err != nil {
 			return nil, err
 		}
@@ -625,8 +2151,8 @@ func chat(
 	}
 
 	sendRequest := func(req *http.Request) (*http.Response, error) {
-		client := &http.Client{}
-		resp, err := client.Do(req)
+		caller := &http.Client{}
+		resp, err := caller.Do(req)
 		if err != nil {
 			return nil, err
 		}
@@ -638,16 +2164,19 @@ func chat(
 		return resp, nil
 	}
 
-	isGemini := strings.Contains(LLMAPIBaseURL, "generativelanguage.google")
-	isStreaming := LLMStreaming && handler != nil
+	isGemini := strings.Contains(client.BaseURL, "generativelanguage.google")
+	isStreaming := client.Streaming && handler != nil
+	if scope == nil {
+		scope = gocontext.Background()
+	}
 
 	req, err := composeRequest(messages, schema, isGemini, isStreaming)
 	if err != nil {
-		return "", err
+		return "", Usage{}, err
 	}
 	resp, err := sendRequest(req)
 	if err != nil {
-		return "", err
+		return "", Usage{}, err
 	}
 	defer resp.Body.Close()
 
@@ -671,19 +2200,32 @@ func chat(
 		}
 	}
 
+	consume := func(data ResponseData, usage *Usage) {
+		if data.Usage != nil {
+			*usage = *data.Usage
+		} else if data.UsageMetadata != nil {
+			// Gemini reports the cumulative count in every chunk
+			usage.PromptTokens = data.UsageMetadata.PromptTokenCount
+			usage.CompletionTokens = data.UsageMetadata.CandidatesTokenCount
+		}
+	}
+
 	if !isStreaming {
 		var data ResponseData
 		err := json.NewDecoder(resp.Body).Decode(&data)
 		if err != nil {
-			return "", err
+			return "", Usage{}, err
 		}
 		answer := extract(data)
 		if handler != nil {
 			handler(answer)
 		}
-		return answer, nil
+		var usage Usage
+		consume(data, &usage)
+		return answer, usage, nil
 
 	} else {
+		var usage Usage
 		parse := func(line string) (string, error) {
 			var partial string
 			payload := line[6:]
@@ -692,6 +2234,7 @@ func chat(
 			if err != nil {
 				return "", err
 			}
+			consume(data, &usage)
 
 			if len(data.Choices) > 0 {
 				partial = data.Choices[0].Delta.Content
@@ -734,475 +2277,3388 @@ func chat(
 			return answer, nil
 		}
 
-		return handleResponseStream(*resp, handler)
+		answer, err := handleResponseStream(*resp, handler)
+		return answer, usage, err
 	}
 }
 
-// reply generates a response based on the context's inquiry and chat history.
-func reply(context Context) (*Context, error) {
-	history := context.History
-	delegates := context.Delegates
-
-	if delegates.Enter != nil {
-		delegates.Enter("Reply")
+// embed converts every text into its embedding vector using the embeddings API.
+// Cancelling the scope (if any) aborts the request.
+func (client *Client) embed(scope gocontext.Context, texts []string) ([][]float64, error) {
+	if scope == nil {
+		scope = gocontext.Background()
 	}
+	isGemini := strings.Contains(client.BaseURL, "generativelanguage.google")
 
-	messages := []Message{
-		{Role: "system", Content: REPLY_PROMPT},
-	}
+	url := func() string {
+		if isGemini {
+			return fmt.Sprintf("%s/models/%s:batchEmbedContents?key=%s", client.BaseURL, client.EmbeddingModel, client.APIKey)
+		}
+		return fmt.Sprintf("%s/embeddings", client.BaseURL)
+	}()
 
-	relevant := history
-	if len(history) >= 5 {
-		relevant = history[len(history)-5:]
+	requestBody := func() any {
+		if isGemini {
+			requests := make([]GeminiEmbeddingRequest, 0)
+			for _, text := range texts {
+				requests = append(requests, GeminiEmbeddingRequest{
+					Model: "models/" + client.EmbeddingModel,
+					Content: GeminiContent{
+						Role:  "user",
+						Parts: []GeminiContentPart{{Text: text}},
+					},
+				})
+			}
+			return EmbeddingRequestGemini{Requests: requests}
+		}
+		return EmbeddingRequest{Model: client.EmbeddingModel, Input: texts}
+	}()
+
+	jsonBody, err := json.Marshal(requestBody)
+	if err != nil {
+		return nil, err
 	}
-	for _, msg := range relevant {
-		messages = append(messages, Message{Role: "user", Content: msg.Inquiry})
-		messages = append(messages, Message{Role: "assistant", Content: msg.Answer})
+	req, err := http.NewRequestWithContext(scope, "POST", url, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if client.APIKey != "" && !isGemini {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", client.APIKey))
 	}
 
-	messages = append(messages, Message{
-		Role:    "user",
-		Content: context.Inquiry,
-	})
-	answer, err := chat(messages, nil, delegates.Stream, nil)
+	caller := &http.Client{}
+	resp, err := caller.Do(req)
 	if err != nil {
 		return nil, err
 	}
-
-	if delegates.Leave != nil {
-		delegates.Leave("Reply", map[string]interface{}{
-			"inquiry": context.Inquiry,
-			"answer":  answer,
-		})
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP error: %d %s", resp.StatusCode, resp.Status)
 	}
 
-	context.Answer = answer
-	return &context, nil
+	var data EmbeddingResponseData
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	var vectors [][]float64
+	for _, item := range data.Data {
+		vectors = append(vectors, item.Embedding)
+	}
+	for _, item := range data.Embeddings {
+		vectors = append(vectors, item.Values)
+	}
+	if len(vectors) != len(texts) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(texts), len(vectors))
+	}
+	return vectors, nil
 }
 
-// reason performs a basic step-by-step reasoning, in the style of Chain of Thought.
-// The updated context will contain new information such as `keyphrases` and `observation`.
-// If the generated keyphrases are empty, the pipeline will retry the reasoning.
-func reason(context Context) (*Context, error) {
-	history := context.History
+// converse performs a chat completion for the named stage, within the scope of the context,
+// and reports the exchange to its delegates.
+func (client *Client) converse(name string, context Context, messages []Message, schema map[string]interface{}, handler func(string)) (string, Usage, error) {
 	delegates := context.Delegates
-
-	if delegates.Enter != nil {
-		delegates.Enter("Reason")
+	start := time.Now()
+	stage := client.stage(name)
+	completion, usage, err := stage.Chat(context.Scope, messages, schema, handler, nil)
+	if delegates.Exchange != nil {
+		delegates.Exchange(Exchange{
+			Model:      stage.ChatModel,
+			Messages:   messages,
+			Schema:     schema,
+			Completion: completion,
+			Usage:      usage,
+			Start:      start,
+			Duration:   time.Since(start),
+			Error:      err,
+		})
 	}
+	return completion, usage, err
+}
 
-	schema := func() map[string]interface{} {
-		if LLMJsonSchema == "" {
-			return nil
+// kind returns the JSON type of the decoded value.
+func kind(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
 		}
-		return REASON_SCHEMA
-	}()
-	prompt := structure(REASON_PROMPT, REASON_GUIDELINE)
-	relevant := history
-	if len(history) >= 3 {
-		relevant = history[len(history)-3:]
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
 	}
-	if len(relevant) == 0 {
-		prompt += structure(REASON_EXAMPLE_INQUIRY, REASON_EXAMPLE_OUTPUT)
+	return fmt.Sprintf("%T", value)
+}
+
+// enumerate returns the items of a list from a schema, either built-in or decoded from JSON.
+func enumerate(list interface{}) []interface{} {
+	switch items := list.(type) {
+	case []interface{}:
+		return items
+	case []string:
+		result := make([]interface{}, len(items))
+		for i, item := range items {
+			result[i] = item
+		}
+		return result
 	}
+	return nil
+}
 
-	var messages []Message
-	messages = append(messages, Message{Role: "system", Content: prompt})
-	for _, msg := range relevant {
-		messages = append(messages, Message{Role: "user", Content: msg.Inquiry})
-		assistant := construct(map[string]string{
-			"tool":        "Google",
-			"thought":     msg.Thought,
-			"keyphrases":  msg.Keyphrases,
-			"observation": msg.Answer,
-			"topic":       msg.Topic,
-		})
-		messages = append(messages, Message{Role: "assistant", Content: assistant})
+// validate checks the decoded value against the JSON schema, supporting type, enum, properties, required,
+// additionalProperties, and items. It returns every violation, each prefixed with its location, e.g. $.topic.
+func validate(schema map[string]interface{}, value interface{}, location string) []string {
+	var violations []string
+	actual := kind(value)
+	if expected, ok := schema["type"]; ok {
+		types := enumerate(expected)
+		if types == nil {
+			types = []interface{}{expected}
+		}
+		matched := false
+		for _, name := range types {
+			if name == actual || (name == "number" && actual == "integer") {
+				matched = true
+			}
+		}
+		if !matched {
+			return []string{fmt.Sprintf("%s: expected %v, got %s", location, expected, actual)}
+		}
+	}
+	if options := enumerate(schema["enum"]); options != nil {
+		matched := false
+		for _, option := range options {
+			if fmt.Sprint(option) == fmt.Sprint(value) {
+				matched = true
+			}
+		}
+		if !matched {
+			violations = append(violations, fmt.Sprintf("%s: %v is not one of %v", location, value, options))
+		}
 	}
 
-	inquiry := context.Inquiry
-	messages = append(messages, Message{Role: "user", Content: inquiry})
-	hint := ""
-	if schema == nil {
-		hint = "tool: Google\nthought: "
-		messages = append(messages, Message{Role: "assistant", Content: hint})
+	if object, ok := value.(map[string]interface{}); ok {
+		properties, _ := schema["properties"].(map[string]interface{})
+		for _, name := range enumerate(schema["required"]) {
+			if _, exists := object[fmt.Sprint(name)]; !exists {
+				violations = append(violations, fmt.Sprintf("%s: missing required property %q", location, name))
+			}
+		}
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if property, declared := properties[key].(map[string]interface{}); declared {
+				violations = append(violations, validate(property, object[key], location+"."+key)...)
+			} else if additional, ok := schema["additionalProperties"].(map[string]interface{}); ok {
+				violations = append(violations, validate(additional, object[key], location+"."+key)...)
+			} else if schema["additionalProperties"] == false {
+				violations = append(violations, fmt.Sprintf("%s: unexpected property %q", location, key))
+			}
+		}
 	}
-	completion, err := chat(messages, schema, nil, nil)
-	if err != nil {
-		return &context, err
+	if array, ok := value.([]interface{}); ok {
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range array {
+				violations = append(violations, validate(items, item, fmt.Sprintf("%s[%d]", location, i))...)
+			}
+		}
 	}
-	result := breakdown(hint, completion)
-	if schema == nil && (result["keyphrases"] == "" || len(result["keyphrases"]) == 0) {
-		if LLMDebugChat != "" {
-			fmt.Println("--> Invalid keyphrases. Trying again...")
+	return violations
+}
+
+// conform performs the chat completion for the named stage and, with a schema, validates the completion
+// against it. On violations, the LLM is asked to repair the completion, up to MAX_REPAIR_ATTEMPT times.
+// Only the first attempt is streamed into the handler. Along with the completion and the total usage,
+// it returns the fields describing the validation (none without a schema). A completion which still
+// violates the schema after the repairs is returned as is, with valid set to false and its violations,
+// leaving the caller to decide what to do with it.
+func (client *Client) conform(name string, context Context, messages []Message, schema map[string]interface{}, handler func(string)) (string, Usage, map[string]interface{}, error) {
+	completion, usage, err := client.converse(name, context, messages, schema, handler)
+	if err != nil || schema == nil {
+		return completion, usage, nil, err
+	}
+
+	repairs := 0
+	for {
+		var value interface{}
+		var violations []string
+		if err := json.Unmarshal([]byte(completion), &value); err != nil {
+			violations = []string{"$: not valid JSON: " + err.Error()}
+		} else {
+			violations = validate(schema, value, "$")
 		}
-		hint = "tool: Google\nthought: " + result["thought"] + "\nkeyphrases: "
-		messages = messages[:len(messages)-1]
-		messages = append(messages, Message{Role: "assistant", Content: hint})
-		completion, err = chat(messages, schema, nil, nil)
+		if len(violations) == 0 {
+			return completion, usage, map[string]interface{}{"valid": true, "repairs": repairs}, nil
+		}
+		if repairs >= MAX_REPAIR_ATTEMPT {
+			if client.DebugChat {
+				fmt.Fprintf(client.Output, "--> Still invalid output after %d repair(s): %s\n", repairs, strings.Join(violations, "; "))
+			}
+			return completion, usage, map[string]interface{}{"valid": false, "repairs": repairs, "violations": violations}, nil
+		}
+		if client.DebugChat {
+			fmt.Fprintf(client.Output, "--> Invalid output: %s. Repairing...\n", strings.Join(violations, "; "))
+		}
+
+		repairs++
+		messages = append(messages,
+			Message{Role: "assistant", Content: completion},
+			Message{Role: "user", Content: "Your output does not conform to the JSON schema:\n- " + strings.Join(violations, "\n- ") +
+				"\nOutput only the corrected JSON object."})
+		var repair Usage
+		completion, repair, err = client.converse(name, context, messages, schema, nil)
+		usage.PromptTokens += repair.PromptTokens
+		usage.CompletionTokens += repair.CompletionTokens
 		if err != nil {
-			return &context, err
+			return completion, usage, nil, err
 		}
-		result = breakdown(hint, completion)
 	}
-	topic := result["topic"]
-	thought := result["thought"]
-	keyphrases := result["keyphrases"]
-	observation := result["observation"]
-	if delegates.Leave != nil {
-		delegates.Leave("Reason", map[string]interface{}{
-			"topic":       topic,
-			"thought":     thought,
-			"keyphrases":  keyphrases,
-			"observation": observation,
-		})
+}
+
+// attribute converts a key-value pair into an OpenTelemetry attribute.
+func attribute(key string, value interface{}) OTLPAttribute {
+	switch v := value.(type) {
+	case int:
+		number := fmt.Sprintf("%d", v)
+		return OTLPAttribute{Key: key, Value: OTLPValue{IntValue: &number}}
+	case int64:
+		number := fmt.Sprintf("%d", v)
+		return OTLPAttribute{Key: key, Value: OTLPValue{IntValue: &number}}
+	case float64:
+		return OTLPAttribute{Key: key, Value: OTLPValue{DoubleValue: &v}}
+	case bool:
+		return OTLPAttribute{Key: key, Value: OTLPValue{BoolValue: &v}}
 	}
+	text := fmt.Sprintf("%v", value)
+	return OTLPAttribute{Key: key, Value: OTLPValue{StringValue: &text}}
+}
 
-	context.History = append(context.History, History{
-		Inquiry:     inquiry,
-		Thought:     thought,
-		Keyphrases:  keyphrases,
-		Topic:       topic,
-		Observation: observation,
-	})
-	return &context, nil
+// identifier generates a random trace or span identifier of the given size (in bytes), in hex.
+func identifier(size int) string {
+	bytes := make([]byte, size)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
 }
 
-// respond responds to the user's recent message using an LLM.
-// The response from the LLM is available as `answer` in the updated context.
-func respond(context Context) (*Context, error) {
-	history := context.History
-	delegates := context.Delegates
+// export sends the spans, in the OTLP/HTTP JSON encoding, to the collector at Config.OTLPEndpoint
+// and/or appends them as a single line to Config.OTLPFile.
+func (client *Client) export(spans []OTLPSpan) error {
+	request := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []OTLPAttribute{attribute("service.name", "query-llm")},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "query-llm"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+	jsonData, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
 
-	if delegates.Enter != nil {
-		delegates.Enter("Respond")
+	if client.OTLPFile != "" {
+		file, err := os.OpenFile(client.OTLPFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if _, err := file.Write(append(jsonData, '\n')); err != nil {
+			return err
+		}
 	}
 
-	schema := RESPOND_SCHEMA
-	if LLMJsonSchema == "" {
-		schema = nil
+	if client.OTLPEndpoint != "" {
+		url := strings.TrimSuffix(client.OTLPEndpoint, "/")
+		if !strings.HasSuffix(url, "/v1/traces") {
+			url += "/v1/traces"
+		}
+		resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("HTTP error: %d %s", resp.StatusCode, resp.Status)
+		}
 	}
-	prompt := RESPOND_PROMPT
-	if schema != nil {
-		prompt += RESPOND_GUIDELINE
+	return nil
+}
+
+// instrument wraps the delegates to record the turn as an OpenTelemetry trace: one span for the turn,
+// one child span for every stage, and one grandchild span for every exchange with the LLM.
+// The trace is exported once the returned function is called with the outcome of the pipeline.
+// Unless Config.OTLPEndpoint or Config.OTLPFile is set, the delegates are left untouched.
+func (client *Client) instrument(inquiry string, delegates Delegates) (Delegates, func(*Context, error)) {
+	if client.OTLPEndpoint == "" && client.OTLPFile == "" {
+		return delegates, func(*Context, error) {}
 	}
-	relevant := history
-	if len(history) >= 2 {
-		relevant = history[len(history)-2:]
+
+	timestamp := func(t time.Time) string {
+		return fmt.Sprintf("%d", t.UnixNano())
 	}
-	if len(relevant) > 0 {
-		prompt += "\n\nFor your reference, you and the user have the following Q&A discussion:\n"
-		for _, msg := range relevant {
-			prompt += fmt.Sprintf("* %s %s\n", msg.Inquiry, msg.Answer)
-		}
+	trace := identifier(16)
+	root := OTLPSpan{
+		TraceID:           trace,
+		SpanID:            identifier(8),
+		Name:              "turn",
+		Kind:              SPAN_KIND_INTERNAL,
+		StartTimeUnixNano: timestamp(time.Now()),
 	}
+	var spans []OTLPSpan
+	var stage *OTLPSpan
+	var usage Usage
 
-	var messages []Message
-	messages = append(messages, Message{Role: "system", Content: prompt})
-	inquiry := context.Inquiry
-	observation := context.Observation
-	messages = append(messages, Message{Role: "user", Content: construct(map[string]string{"inquiry": inquiry, "observation": observation})})
-	if schema == nil {
-		messages = append(messages, Message{Role: "assistant", Content: "Answer: "})
+	traced := delegates
+	traced.Enter = func(name string) {
+		stage = &OTLPSpan{
+			TraceID:           trace,
+			SpanID:            identifier(8),
+			ParentSpanID:      root.SpanID,
+			Name:              name,
+			Kind:              SPAN_KIND_INTERNAL,
+			StartTimeUnixNano: timestamp(time.Now()),
+		}
+		if delegates.Enter != nil {
+			delegates.Enter(name)
+		}
 	}
-	completion, err := chat(messages, schema, delegates.Stream, nil)
-	if err != nil {
-		return &context, err
+	traced.Leave = func(name string, fields map[string]interface{}) {
+		if stage != nil {
+			stage.EndTimeUnixNano = timestamp(time.Now())
+			keys := make([]string, 0, len(fields))
+			for key := range fields {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				switch key {
+				case "prompt_tokens":
+					stage.Attributes = append(stage.Attributes, attribute("gen_ai.usage.input_tokens", fields[key]))
+				case "completion_tokens":
+					stage.Attributes = append(stage.Attributes, attribute("gen_ai.usage.output_tokens", fields[key]))
+				default:
+					stage.Attributes = append(stage.Attributes, attribute("query_llm."+key, fields[key]))
+				}
+			}
+			spans = append(spans, *stage)
+			stage = nil
+		}
+		if delegates.Leave != nil {
+			delegates.Leave(name, fields)
+		}
 	}
-	answer := completion
-	if schema != nil {
-		answer = breakdown("", completion)["answer"]
+	traced.Exchange = func(exchange Exchange) {
+		parent := root.SpanID
+		if stage != nil {
+			parent = stage.SpanID
+		}
+		span := OTLPSpan{
+			TraceID:           trace,
+			SpanID:            identifier(8),
+			ParentSpanID:      parent,
+			Name:              "chat " + exchange.Model,
+			Kind:              SPAN_KIND_CLIENT,
+			StartTimeUnixNano: timestamp(exchange.Start),
+			EndTimeUnixNano:   timestamp(exchange.Start.Add(exchange.Duration)),
+			Attributes: []OTLPAttribute{
+				attribute("gen_ai.operation.name", "chat"),
+				attribute("gen_ai.request.model", exchange.Model),
+				attribute("gen_ai.usage.input_tokens", exchange.Usage.PromptTokens),
+				attribute("gen_ai.usage.output_tokens", exchange.Usage.CompletionTokens),
+				attribute("query_llm.messages", len(exchange.Messages)),
+				attribute("query_llm.schema", exchange.Schema != nil),
+			},
+		}
+		if exchange.Error != nil {
+			span.Status = OTLPStatus{Code: STATUS_CODE_ERROR, Message: exchange.Error.Error()}
+		}
+		spans = append(spans, span)
+		usage.PromptTokens += exchange.Usage.PromptTokens
+		usage.CompletionTokens += exchange.Usage.CompletionTokens
+		if delegates.Exchange != nil {
+			delegates.Exchange(exchange)
+		}
 	}
 
-	if delegates.Leave != nil {
-		delegates.Leave("Respond", map[string]interface{}{
-			"inquiry":     inquiry,
-			"observation": observation,
-			"answer":      answer,
-		})
+	finish := func(result *Context, err error) {
+		now := timestamp(time.Now())
+		if stage != nil {
+			stage.EndTimeUnixNano = now
+			if err != nil {
+				stage.Status = OTLPStatus{Code: STATUS_CODE_ERROR, Message: err.Error()}
+			}
+			spans = append(spans, *stage)
+			stage = nil
+		}
+		root.EndTimeUnixNano = now
+		root.Attributes = []OTLPAttribute{
+			attribute("query_llm.inquiry", inquiry),
+			attribute("gen_ai.request.model", client.ChatModel),
+			attribute("gen_ai.usage.input_tokens", usage.PromptTokens),
+			attribute("gen_ai.usage.output_tokens", usage.CompletionTokens),
+		}
+		if result != nil {
+			root.Attributes = append(root.Attributes, attribute("query_llm.answer", result.Answer))
+		}
+		if err != nil {
+			root.Status = OTLPStatus{Code: STATUS_CODE_ERROR, Message: err.Error()}
+		}
+		if err := client.export(append(spans, root)); err != nil {
+			fmt.Fprintln(client.Output, "ERROR: unable to export the trace:", err)
+		}
 	}
 
-	context.History = append(context.History, History{
-		Inquiry:     inquiry,
-		Observation: observation,
-		Answer:      answer,
-	})
-	return &context, nil
+	return traced, finish
 }
 
-// evaluate evaluates a test file and executes the test cases.
-func evaluate(filename string) {
-	history := make([]History, 0)
-	total := 0
-	failures := 0
+// inscribe appends the record, as a single line of JSON, to the trace log.
+func (client *Client) inscribe(record Record) {
+	traces.Lock()
+	defer traces.Unlock()
 
-	handle := func(line string) error {
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) < 2 {
-			return nil
+	jsonData, err := json.Marshal(record)
+	if err == nil {
+		var file *os.File
+		file, err = os.OpenFile(client.TraceFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = file.Write(append(jsonData, '\n'))
+			file.Close()
 		}
-		role := parts[0]
-		content := strings.TrimSpace(parts[1])
+	}
+	if err != nil {
+		fmt.Fprintln(client.Output, "ERROR: unable to write the trace:", err)
+	}
+}
 
-		if role == "Story" {
-			fmt.Println()
-			fmt.Println("-----------------------------------")
-			fmt.Printf("Story: %s%s%s\n", MAGENTA, BOLD, content, NORMAL)
-			fmt.Println("-----------------------------------")
-			history = make([]History, 0)
+// journal wraps the delegates to append every exchange with the LLM to the trace log (see Config.TraceFile),
+// and returns the function to append the record of the whole turn once it is complete.
+// Every record is also passed to the sinks, if any. Without any sink and unless Config.TraceFile is set,
+// the delegates are left untouched.
+func (client *Client) journal(origin Record, delegates Delegates, sinks ...func(Record)) (Delegates, func(Record)) {
+	if client.TraceFile != "" {
+		sinks = append(sinks, client.inscribe)
+	}
+	if len(sinks) == 0 {
+		return delegates, func(Record) {}
+	}
+	write := func(record Record) {
+		for _, sink := range sinks {
+			sink(record)
+		}
+	}
 
-		} else if role == "User" {
-			inquiry := content
-			stages := make([]Stage, 0)
-			enter := func(name string) {
-				stages = append(stages, Stage{Name: name, Timestamp: time.Now().UnixNano() / int64(time.Millisecond)})
+	origin.Turn = identifier(8)
+	origin.Time = time.Now().Format(time.RFC3339Nano)
+	origin.Model = client.ChatModel
+	stage := ""
+	attempts := make(map[string]int)
+	var usage Usage
+
+	traced := delegates
+	traced.Enter = func(name string) {
+		stage = name
+		if delegates.Enter != nil {
+			delegates.Enter(name)
+		}
+	}
+	traced.Exchange = func(exchange Exchange) {
+		attempts[stage]++
+		record := origin
+		record.Type = "chat"
+		record.Time = exchange.Start.Format(time.RFC3339Nano)
+		record.Stage = stage
+		record.Attempt = attempts[stage]
+		record.Model = exchange.Model
+		record.Messages = exchange.Messages
+		record.Schema = exchange.Schema
+		record.Completion = exchange.Completion
+		record.PromptTokens = exchange.Usage.PromptTokens
+		record.CompletionTokens = exchange.Usage.CompletionTokens
+		record.Duration = exchange.Duration.Milliseconds()
+		if exchange.Error != nil {
+			record.Error = exchange.Error.Error()
+		} else if exchange.Schema != nil {
+			record.Breakdown, _ = client.breakdown("", exchange.Completion)
+		} else if last := exchange.Messages[len(exchange.Messages)-1]; last.Role == "assistant" {
+			record.Breakdown, _ = client.breakdown(last.Content, exchange.Completion)
+		}
+		write(record)
+
+		usage.PromptTokens += exchange.Usage.PromptTokens
+		usage.CompletionTokens += exchange.Usage.CompletionTokens
+		if delegates.Exchange != nil {
+			delegates.Exchange(exchange)
+		}
+	}
+
+	finish := func(record Record) {
+		record.Type = "turn"
+		record.Turn = origin.Turn
+		record.Time = origin.Time
+		record.File = origin.File
+		record.Story = origin.Story
+		record.Inquiry = origin.Inquiry
+		record.Model = origin.Model
+		if record.PromptTokens+record.CompletionTokens == 0 {
+			record.PromptTokens = usage.PromptTokens
+			record.CompletionTokens = usage.CompletionTokens
+		}
+		write(record)
+	}
+
+	return traced, finish
+}
+
+// connect launches the MCP server as a subprocess, communicating over stdio,
+// and returns the tools it offers, along with the function to stop the server.
+func connect(name string, server MCPServer) ([]Tool, func(), error) {
+	command := exec.Command(server.Command, server.Args...)
+	command.Env = os.Environ()
+	for key, value := range server.Env {
+		command.Env = append(command.Env, key+"="+value)
+	}
+	command.Stderr = os.Stderr
+	stdin, err := command.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	stdout, err := command.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := command.Start(); err != nil {
+		return nil, nil, err
+	}
+
+	// every line from the server is read in the background, so that a request can give up waiting
+	lines := make(chan []byte)
+	done := make(chan struct{})
+	go func() {
+		defer close(lines)
+		reader := bufio.NewReader(stdout)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				return
 			}
-			leave := func(name string, fields map[string]interface{}) {
-				stages = append(stages, Stage{Name: name, Timestamp: time.Now().UnixNano() / int64(time.Millisecond), Fields: fields})
+			select {
+			case lines <- line:
+			case <-done:
+				return
 			}
+		}
+	}()
 
-			context := Context{
-				Inquiry: inquiry,
-				History: history,
-				Delegates: Delegates{
-					Enter: enter,
-					Leave: leave,
-				},
-			}
-			fmt.Printf("  %s\r", inquiry)
-			start := time.Now()
-			pipeline := func() func(Context) (*Context, error) {
-				if LLMZeroShot != "" {
-					return reply
-				} else {
-					return pipe(reason, respond)
-				}
+	// stop closes the input of the server, which should then exit; otherwise it is killed.
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(done)
+			stdin.Close()
+			exited := make(chan error, 1)
+			go func() {
+				exited <- command.Wait()
 			}()
-			result, err := pipeline(context)
-			if err != nil {
-				return nil
+			select {
+			case <-exited:
+			case <-time.After(MCP_GRACE_IN_SECONDS * time.Second):
+				command.Process.Kill()
+				<-exited
 			}
-			duration := time.Since(start).Milliseconds()
-
-			history = append(history, History{
-				Inquiry:    inquiry,
-				Thought:    result.Thought,
-				Keyphrases: result.Keyphrases,
-				Topic:      result.Topic,
-				Answer:     result.Answer,
-				Duration:   duration,
-				Stages:     stages,
-			})
-			total++
+		})
+	}
 
-		} else if role == "Assistant" {
-			expected := content
-			if len(history) == 0 {
-				fmt.Println("There is no answer yet!")
-				os.Exit(-1)
-			}
-			last := history[len(history)-1]
-
-			inquiry := last.Inquiry
-			answer := last.Answer
-			duration := last.Duration
-			stages := last.Stages
-			target := answer
-			regexes := regexify(expected)
-			matches := match(target, regexes)
-
-			if len(matches) == len(regexes) {
-				fmt.Printf("%s%s %s%s %s[%d ms]%s\n", GREEN, CHECK, CYAN, inquiry, GRAY, duration, NORMAL)
-				fmt.Println(" ", highlight(target, matches, GREEN))
-				if LLMDebugPipeline != "" {
-					review(simplify(stages))
-				}
-			} else {
-				failures++
-				fmt.Printf("%s%s %s%s %s[%d ms]%s\n", RED, CROSS, YELLOW, inquiry, GRAY, duration, NORMAL)
-				fmt.Printf("Expected %s to contain: %s%s%s\n", role, CYAN, regexes, NORMAL)
-				fmt.Printf("Actual %s: %s%s%s\n", role, MAGENTA, target, NORMAL)
-				review(simplify(stages))
-				if LLMDebugFailExit != "" {
-					os.Exit(-1)
+	var lock sync.Mutex
+	id := 0
+	send := func(message map[string]interface{}) error {
+		message["jsonrpc"] = "2.0"
+		jsonData, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		_, err = stdin.Write(append(jsonData, '\n'))
+		return err
+	}
+	// request sends a JSON-RPC request, and waits for its response while skipping everything else.
+	request := func(method string, params interface{}) (json.RawMessage, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		id++
+		if err := send(map[string]interface{}{"id": id, "method": method, "params": params}); err != nil {
+			return nil, err
+		}
+		// a late response to an abandoned request is skipped by the next one, as its id does not match
+		timer := time.NewTimer(MCP_TIMEOUT_IN_SECONDS * time.Second)
+		defer timer.Stop()
+		for {
+			var line []byte
+			select {
+			case received, open := <-lines:
+				if !open {
+					return nil, fmt.Errorf("%s: the server has exited", name)
 				}
+				line = received
+			case <-timer.C:
+				return nil, fmt.Errorf("%s: no response to %s within %d seconds", name, method, MCP_TIMEOUT_IN_SECONDS)
 			}
-
-		} else if LLMZeroShot == "" {
-			if role == "Pipeline.Reason.Keyphrases" || role == "Pipeline.Reason.Topic" {
-				expected := content
-				if len(history) == 0 {
-					fmt.Println("There is no answer yet!")
-					os.Exit(-1)
-				} else {
-					last := history[len(history)-1]
-					var target string
-					if role == "Pipeline.Reason.Keyphrases" {
-						target = last.Keyphrases
-					} else {
-						target = last.Topic
-					}
-					regexes := regexify(expected)
-					matches := match(target, regexes)
-					if len(matches) == len(regexes) {
-						fmt.Printf("%s    %s %s: %s\n", GRAY, ARROW, role, highlight(target, matches, GREEN))
-					} else {
-						failures++
-						fmt.Printf("%sExpected %s to contain: %s%s%s\n", RED, role, CYAN, regexes, NORMAL)
-						fmt.Printf("%sActual %s: %s%s%s\n", RED, role, MAGENTA, target, NORMAL)
-						review(simplify(last.Stages))
-						if LLMDebugFailExit != "" {
-							os.Exit(-1)
-						}
-					}
-				}
-			} else {
-				fmt.Printf("Unknown role: %s!\n", role)
-				os.Exit(-1)
+			var response struct {
+				ID     *int            `json:"id"`
+				Method string          `json:"method"`
+				Result json.RawMessage `json:"result"`
+				Error  *struct {
+					Message string `json:"message"`
+				} `json:"error"`
 			}
+			if json.Unmarshal(line, &response) != nil || response.ID == nil || response.Method != "" || *response.ID != id {
+				continue
+			}
+			if response.Error != nil {
+				return nil, fmt.Errorf("%s: %s", name, response.Error.Message)
+			}
+			return response.Result, nil
 		}
-		return nil
-	}
-
-	trim := func(input string) string {
-		text := strings.TrimSpace(input)
-		marker := strings.Index(text, "#")
-		if marker >= 0 {
-			return strings.TrimSpace(text[:marker])
-		}
-		return text
 	}
 
-	file, err := os.Open(filename)
+	_, err = request("initialize", map[string]interface{}{
+		"protocolVersion": "2024-11-05",
+		"capabilities":    map[string]interface{}{},
+		"clientInfo":      map[string]interface{}{"name": "query-llm", "version": "1.0.0"},
+	})
 	if err != nil {
-		fmt.Println("ERROR:", err)
-		os.Exit(-1)
+		stop()
+		return nil, nil, err
+	}
+	if err := send(map[string]interface{}{"method": "notifications/initialized"}); err != nil {
+		stop()
+		return nil, nil, err
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		err := handle(trim(scanner.Text()))
+	var tools []Tool
+	cursor := ""
+	for {
+		params := map[string]interface{}{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+		result, err := request("tools/list", params)
 		if err != nil {
-			fmt.Println("ERROR:", err)
-			os.Exit(-1)
+			stop()
+			return nil, nil, err
+		}
+		var page struct {
+			Tools      []Tool `json:"tools"`
+			NextCursor string `json:"nextCursor"`
+		}
+		if err := json.Unmarshal(result, &page); err != nil {
+			stop()
+			return nil, nil, err
+		}
+		tools = append(tools, page.Tools...)
+		cursor = page.NextCursor
+		if cursor == "" {
+			break
 		}
 	}
 
-	if failures <= 0 {
-		fmt.Printf("%s%s%s SUCCESS: %s%d test(s)%s.\n", GREEN, CHECK, NORMAL, GREEN, total, NORMAL)
-	} else {
-		fmt.Printf("%s%s%s FAIL: %s%d test(s), %s%d failure(s)%s.\n", RED, CROSS, NORMAL, GRAY, total, RED, failures, NORMAL)
-		os.Exit(-1)
-	}
-	if err := scanner.Err(); err != nil {
-		fmt.Println("ERROR:", err)
-		os.Exit(-1)
+	for i := range tools {
+		tool := &tools[i]
+		tool.Server = name
+		toolName := tool.Name
+		tool.Call = func(arguments map[string]interface{}) (string, error) {
+			result, err := request("tools/call", map[string]interface{}{"name": toolName, "arguments": arguments})
+			if err != nil {
+				return "", err
+			}
+			var outcome struct {
+				Content []struct {
+					Type string `json:"type"`
+					Text string `json:"text"`
+				} `json:"content"`
+				IsError bool `json:"isError"`
+			}
+			if err := json.Unmarshal(result, &outcome); err != nil {
+				return "", err
+			}
+			var texts []string
+			for _, content := range outcome.Content {
+				if content.Type == "text" {
+					texts = append(texts, content.Text)
+				}
+			}
+			text := strings.Join(texts, "\n")
+			if outcome.IsError {
+				return "", fmt.Errorf("%s: %s", toolName, text)
+			}
+			return text, nil
+		}
 	}
+	return tools, stop, nil
 }
 
-func interact() {
-	history := make([]History, 0)
-	loop := true
-	scanner := bufio.NewScanner(os.Stdin)
+// equip connects to every MCP server listed in the config (see Config.MCPConfig), once,
+// and returns all the tools they offer.
+func (client *Client) equip() []Tool {
+	client.toolbox.Do(func() {
+		if client.MCPConfig == "" {
+			return
+		}
+		var config struct {
+			Servers map[string]MCPServer `json:"mcpServers"`
+		}
+		jsonData, err := os.ReadFile(client.MCPConfig)
+		if err == nil {
+			err = json.Unmarshal(jsonData, &config)
+		}
+		if err != nil {
+			fmt.Fprintln(client.Output, "ERROR: unable to load the MCP config:", err)
+			return
+		}
+		names := make([]string, 0, len(config.Servers))
+		for name := range config.Servers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			tools, stop, err := connect(name, config.Servers[name])
+			if err != nil {
+				fmt.Fprintf(client.Output, "ERROR: unable to connect to the MCP server %s: %v\n", name, err)
+				continue
+			}
+			client.toolbox.tools = append(client.toolbox.tools, tools...)
+			client.toolbox.stops = append(client.toolbox.stops, stop)
+		}
+	})
+	return client.toolbox.tools
+}
 
-	var qa func()
-	qa = func() {
-		fmt.Print(YELLOW + ">> " + CYAN)
-		if !scanner.Scan() {
-			loop = false
+// Close stops the MCP servers launched for the tools, if any, and waits for them to exit.
+// The clients sharing the same resources (see adapt) can no longer use the tools afterwards.
+func (client *Client) Close() {
+	client.toolbox.Do(func() {})
+	for _, stop := range client.toolbox.stops {
+		stop()
+	}
+}
+
+// enlist extends the schema of the reasoning with the tools from the MCP servers and their arguments.
+func enlist(schema map[string]interface{}, tools []Tool) map[string]interface{} {
+	properties, ok := schema["properties"].(map[string]interface{})
+	if !ok {
+		return schema
+	}
+	names := []string{"Google"}
+	for _, tool := range tools {
+		names = append(names, tool.Name)
+	}
+
+	extended := make(map[string]interface{})
+	for key, value := range properties {
+		extended[key] = value
+	}
+	extended["tool"] = map[string]interface{}{"type": "string", "enum": names}
+	extended["arguments"] = map[string]interface{}{"type": "string"}
+	required := []string{"arguments"}
+	switch list := schema["required"].(type) {
+	case []string:
+		required = append(required, list...)
+	case []interface{}:
+		for _, item := range list {
+			required = append(required, fmt.Sprint(item))
+		}
+	}
+	result := make(map[string]interface{})
+	for key, value := range schema {
+		result[key] = value
+	}
+	result["properties"] = extended
+	result["required"] = required
+	return result
+}
+
+// wield runs the tool chosen during the reasoning, if it is one from the MCP servers.
+// The result of the tool, or the reason of its failure, becomes the observation.
+func (client *Client) wield(tools []Tool, name, arguments string) (string, bool) {
+	for _, tool := range tools {
+		if !strings.EqualFold(tool.Name, strings.TrimSpace(name)) {
+			continue
+		}
+		input := make(map[string]interface{})
+		if strings.TrimSpace(arguments) != "" {
+			if err := json.Unmarshal([]byte(arguments), &input); err != nil {
+				return fmt.Sprintf("Invalid arguments for %s: %v", tool.Name, err), true
+			}
+		}
+		if client.DebugChat {
+			fmt.Fprintf(client.Output, "--> Calling %s (%s) with %s\n", tool.Name, tool.Server, arguments)
+		}
+		result, err := tool.Call(input)
+		if err != nil {
+			return fmt.Sprintf("The tool %s failed: %v", tool.Name, err), true
+		}
+		return result, true
+	}
+	return "", false
+}
+
+// examples loads the few-shot examples from Config.ExampleFile once, one JSON object per line.
+// For the matching by embedding, the inquiries of the examples are embedded as well.
+func (client *Client) examples() ([]Example, error) {
+	client.library.Do(func() {
+		if client.ExampleFile == "" {
 			return
 		}
-		inquiry := scanner.Text()
-		fmt.Print(NORMAL)
-		if inquiry == "!review" || inquiry == "/review" {
-			if len(history) == 0 {
-				fmt.Println("Nothing to review yet!")
-				fmt.Println()
-			} else {
-				last := history[len(history)-1]
-				stages := last.Stages
-				review(simplify(stages))
+		data, err := os.ReadFile(client.ExampleFile)
+		if err != nil {
+			client.library.err = fmt.Errorf("unable to load the examples: %w", err)
+			return
+		}
+		var examples []Example
+		for number, line := range strings.Split(string(data), "\n") {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			var example Example
+			if err := json.Unmarshal([]byte(line), &example); err != nil {
+				client.library.err = fmt.Errorf("unable to load the examples: %s:%d: %w", client.ExampleFile, number+1, err)
+				return
+			}
+			if example.Tool == "" {
+				example.Tool = "Google"
+			}
+			examples = append(examples, example)
+		}
+		if client.ExampleMatch == "embedding" && len(examples) > 0 {
+			inquiries := make([]string, len(examples))
+			for i, example := range examples {
+				inquiries[i] = example.Inquiry
+			}
+			client.library.vectors, err = client.embed(nil, inquiries)
+			if err != nil {
+				fmt.Fprintln(client.Output, "ERROR: unable to embed the examples, matching by keyword instead:", err)
 			}
+		}
+		client.library.examples = examples
+	})
+	return client.library.examples, client.library.err
+}
+
+// keywords returns the distinct lowercase words of the text, except the short and the most common ones.
+func keywords(text string) map[string]bool {
+	common := map[string]bool{
+		"the": true, "and": true, "for": true, "are": true, "was": true, "were": true, "what": true, "which": true,
+		"who": true, "whom": true, "whose": true, "when": true, "where": true, "why": true, "how": true, "does": true,
+		"did": true, "with": true, "from": true, "this": true, "that": true, "these": true, "those": true, "about": true,
+		"into": true, "its": true, "has": true, "have": true, "had": true, "can": true, "you": true, "your": true,
+	}
+	result := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(word) > 2 && !common[word] {
+			result[word] = true
+		}
+	}
+	return result
+}
+
+// exemplify picks up to Config.ExampleCount examples most relevant to the inquiry, by keyword overlap
+// or, with Config.ExampleMatch set to embedding, by the similarity of their embeddings.
+// Irrelevant examples, i.e. without any common keyword or below EXAMPLE_THRESHOLD, are never picked.
+// The most relevant example comes last, i.e. nearest to the inquiry.
+func (client *Client) exemplify(scope gocontext.Context, inquiry string) ([]Example, error) {
+	examples, err := client.examples()
+	if err != nil || len(examples) == 0 || client.ExampleCount <= 0 {
+		return nil, err
+	}
+
+	scores := make([]float64, len(examples))
+	floor := 0.0
+	matched := false
+	if client.ExampleMatch == "embedding" && len(client.library.vectors) == len(examples) {
+		vectors, err := client.embed(scope, []string{inquiry})
+		if err != nil {
+			fmt.Fprintln(client.Output, "ERROR: unable to embed the inquiry, matching the examples by keyword instead:", err)
 		} else {
-			input := ""
-			output := ""
-			stream := func(text string) {
-				if LLMJsonSchema != "" {
-					input += text
-					answerObj := unJSON(input)["answer"]
-					if answerObj != nil {
-						answer := answerObj.(string)
-						if len(answer) > 0 {
-							fmt.Print(answer[len(output):])
-							output = answer
-						}
-					}
-				} else {
-					fmt.Print(text)
+			for i, vector := range client.library.vectors {
+				scores[i] = cosine(vectors[0], vector)
+			}
+			floor = EXAMPLE_THRESHOLD
+			matched = true
+		}
+	}
+	if !matched {
+		target := keywords(inquiry)
+		for i, example := range examples {
+			for word := range keywords(example.Inquiry + " " + example.Keyphrases + " " + example.Topic) {
+				if target[word] {
+					scores[i]++
 				}
 			}
+		}
+	}
 
-			stages := []Stage{}
-			update := func(stage string, fields map[string]interface{}) {
-				if stage == "Reason" {
-					keyphrases := fields["keyphrases"].(string)
-					if len(keyphrases) > 0 {
-						fmt.Printf("%s%s Searching for %s...%s\n", GRAY, ARROW, keyphrases, NORMAL)
-					}
-				}
+	var order []int
+	for i, score := range scores {
+		if score > 0 && score >= floor {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return scores[order[i]] > scores[order[j]]
+	})
+	if len(order) > client.ExampleCount {
+		order = order[:client.ExampleCount]
+	}
+	picked := make([]Example, len(order))
+	for i, index := range order {
+		picked[len(order)-1-i] = examples[index]
+	}
+	return picked, nil
+}
+
+// compose parses a prompt template, after its metadata in the YAML front matter (between two --- lines).
+func (client *Client) compose(name, text string) (Prompt, error) {
+	prompt := Prompt{Name: name, Schema: "none"}
+	if _, found := SCHEMAS[name]; found {
+		prompt.Schema = name
+	}
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	if strings.HasPrefix(text, "---\n") {
+		header, body, found := strings.Cut("\n"+text[4:], "\n---\n")
+		if !found {
+			return prompt, errors.New("the front matter is not terminated with ---")
+		}
+		metadata, err := unYAML(header)
+		if err != nil {
+			return prompt, err
+		}
+		if schema, ok := metadata["schema"].(string); ok && schema != "" {
+			prompt.Schema = schema
+		}
+		text = body
+	}
+
+	if schema, found := SCHEMAS[prompt.Schema]; found {
+		prompt.shape = schema
+	} else if prompt.Schema != "none" {
+		jsonData, err := os.ReadFile(filepath.Join(client.PromptDir, prompt.Schema))
+		if err == nil {
+			err = json.Unmarshal(jsonData, &prompt.shape)
+		}
+		if err != nil {
+			return prompt, fmt.Errorf("schema %s: %w", prompt.Schema, err)
+		}
+	}
+
+	helpers := txttemplate.FuncMap{
+		"trim": strings.TrimSpace,
+		"json": func(value interface{}) string {
+			jsonData, _ := json.Marshal(value)
+			return string(jsonData)
+		},
+		// format lays out the key-value pairs as the expected output, following the prefix before it.
+		"format": func(pairs ...string) (string, error) {
+			if len(pairs)%2 != 0 {
+				return "", errors.New("format expects pairs of key and value")
 			}
-			enter := func(name string) {
-				stages = append(stages, Stage{Name: name, Timestamp: time.Now().Unix()})
+			object := make(map[string]string)
+			for i := 0; i < len(pairs); i += 2 {
+				object[pairs[i]] = pairs[i+1]
 			}
-			leave := func(name string, fields map[string]interface{}) {
-				update(name, fields)
-				stages = append(stages, Stage{Name: name, Timestamp: time.Now().Unix(), Fields: fields})
+			if client.JSONSchema {
+				jsonData, _ := json.MarshalIndent(object, "", "  ")
+				return " (JSON with this schema)\n" + string(jsonData) + "\n", nil
 			}
-			delegates := Delegates{Stream: stream, Enter: enter, Leave: leave}
-			context := Context{Inquiry: inquiry, History: history, Delegates: delegates}
-			start := time.Now()
-			pipeline := func() func(Context) (*Context, error) {
-				if LLMZeroShot != "" {
-					return reply
-				} else {
-					return pipe(reason, respond)
+			return "\n\n" + client.construct(object) + "\n", nil
+		},
+	}
+	var err error
+	prompt.Template, err = txttemplate.New(name).Funcs(helpers).Parse(strings.TrimSuffix(text, "\n"))
+	return prompt, err
+}
+
+// prompts loads the templates of the system prompts once, from Config.PromptDir if present there,
+// or else the built-in ones.
+func (client *Client) prompts() (map[string]Prompt, error) {
+	client.templates.Do(func() {
+		prompts := make(map[string]Prompt)
+		for name, text := range PROMPTS {
+			if client.PromptDir != "" {
+				data, err := os.ReadFile(filepath.Join(client.PromptDir, name+".tmpl"))
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					client.templates.err = err
+					return
 				}
-			}()
-			result, err := pipeline(context)
+				if err == nil {
+					text = string(data)
+				}
+			}
+			prompt, err := client.compose(name, text)
 			if err != nil {
-				fmt.Println("ERROR:", err)
-				fmt.Println()
-				os.Exit(-1)
+				client.templates.err = fmt.Errorf("prompt %s: %w", name, err)
+				return
 			}
-			duration := time.Since(start).Milliseconds()
-			history = append(history, History{
-				Inquiry:    inquiry,
-				Thought:    result.Thought,
-				Keyphrases: result.Keyphrases,
-				Topic:      result.Topic,
-				Answer:     result.Answer,
-				Duration:   duration,
-				Stages:     stages,
-			})
-			fmt.Println()
+			prompts[name] = prompt
 		}
-		if loop {
-			qa()
+		client.templates.prompts = prompts
+	})
+	return client.templates.prompts, client.templates.err
+}
+
+// locale returns the locale of the user, e.g. en_US, from the usual environment variables.
+func locale() string {
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		value, _, _ := strings.Cut(os.Getenv(name), ".")
+		if value != "" && value != "C" && value != "POSIX" {
+			return value
 		}
 	}
+	return "en_US"
+}
 
-	qa()
+// render executes the prompt template of the stage, and returns the system prompt along with its schema.
+// Without Config.JSONSchema, there is no schema.
+func (client *Client) render(name string, context Context, relevant []History, examples []Example) (string, map[string]interface{}, error) {
+	prompts, err := client.prompts()
+	if err != nil {
+		return "", nil, err
+	}
+	prompt := prompts[name]
+	setting := Setting{
+		Inquiry:    context.Inquiry,
+		History:    relevant,
+		Topic:      context.Topic,
+		Date:       time.Now().Format("2006-01-02"),
+		Locale:     locale(),
+		JSONSchema: client.JSONSchema,
+		Tools:      client.equip(),
+		Examples:   examples,
+		Language:   context.Language,
+	}
+	if setting.Topic == "" && len(context.History) > 0 {
+		setting.Topic = context.History[len(context.History)-1].Topic
+	}
+	var buffer bytes.Buffer
+	if err := prompt.Template.Execute(&buffer, setting); err != nil {
+		return "", nil, fmt.Errorf("prompt %s: %w", name, err)
+	}
+	if !client.JSONSchema {
+		return buffer.String(), nil, nil
+	}
+	return buffer.String(), prompt.shape, nil
+}
+
+// ExportPrompts writes the built-in prompt templates, and the schemas they refer to, into the directory
+// as a starting point for Config.PromptDir, and returns the written files. Existing files are overwritten only if requested.
+func ExportPrompts(dir string, overwrite bool) ([]string, error) {
+	files := make(map[string]string)
+	for name, text := range PROMPTS {
+		files[name+".tmpl"] = text
+	}
+	for name, schema := range SCHEMAS {
+		jsonData, _ := json.MarshalIndent(schema, "", "  ")
+		files[name+".json"] = string(jsonData) + "\n"
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		filename := filepath.Join(dir, name)
+		if _, err := os.Stat(filename); err == nil && !overwrite {
+			return nil, fmt.Errorf("%s already exists", filename)
+		}
+	}
+	var written []string
+	for _, name := range names {
+		filename := filepath.Join(dir, name)
+		if err := os.WriteFile(filename, []byte(files[name]), 0644); err != nil {
+			return written, err
+		}
+		written = append(written, filename)
+	}
+	return written, nil
+}
+
+// Detect detects the language of the inquiry, and decides the language of the answer:
+// the detected one (or else English) with Config.Language set to auto, otherwise the configured one.
+func (client *Client) Detect(context Context) (*Context, error) {
+	delegates := context.Delegates
+
+	if delegates.Enter != nil {
+		delegates.Enter("Detect")
+	}
+
+	detected, similarity := Recognize(context.Inquiry)
+	language := client.Language
+	for _, known := range LANGUAGES {
+		if strings.EqualFold(language, known.Code) || strings.EqualFold(language, known.Name) {
+			language = known.Name
+		}
+	}
+	if strings.EqualFold(language, "auto") {
+		language = detected
+		if language == "" {
+			language = "English"
+		}
+	}
+
+	if delegates.Leave != nil {
+		delegates.Leave("Detect", map[string]interface{}{
+			"inquiry":    context.Inquiry,
+			"detected":   detected,
+			"similarity": math.Round(similarity*1000) / 1000,
+			"language":   language,
+		})
+	}
+
+	context.Language = language
+	return &context, nil
+}
+
+// Reply generates a response based on the context's inquiry and chat history.
+func (client *Client) Reply(context Context) (*Context, error) {
+	history := context.History
+	delegates := context.Delegates
+
+	if delegates.Enter != nil {
+		delegates.Enter("Reply")
+	}
+
+	relevant := history
+	if len(history) >= 5 {
+		relevant = history[len(history)-5:]
+	}
+	prompt, _, err := client.render("reply", context, relevant, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []Message{
+		{Role: "system", Content: prompt},
+	}
+	for _, msg := range relevant {
+		messages = append(messages, Message{Role: "user", Content: msg.Inquiry})
+		messages = append(messages, Message{Role: "assistant", Content: msg.Answer})
+	}
+
+	messages = append(messages, Message{
+		Role:    "user",
+		Content: context.Inquiry,
+	})
+	answer, usage, err := client.converse("Reply", context, messages, nil, delegates.Stream)
+	if err != nil {
+		return nil, err
+	}
+
+	if delegates.Leave != nil {
+		delegates.Leave("Reply", map[string]interface{}{
+			"inquiry":           context.Inquiry,
+			"answer":            answer,
+			"prompt_tokens":     usage.PromptTokens,
+			"completion_tokens": usage.CompletionTokens,
+		})
+	}
+
+	context.Answer = answer
+	return &context, nil
 }
 
-func main() {
-	fmt.Printf("Using LLM at %s (model: %s%s%s).\n", LLMAPIBaseURL, GREEN, LLMChatModel, NORMAL)
+// Reason performs a basic step-by-step reasoning, in the style of Chain of Thought.
+// The updated context will contain new information such as `keyphrases` and `observation`.
+// If the generated keyphrases are empty, the pipeline will retry the reasoning.
+func (client *Client) Reason(context Context) (*Context, error) {
+	history := context.History
+	delegates := context.Delegates
+
+	if delegates.Enter != nil {
+		delegates.Enter("Reason")
+	}
+
+	tools := client.equip()
+	relevant := history
+	if len(history) >= 3 {
+		relevant = history[len(history)-3:]
+	}
+	examples, err := client.exemplify(context.Scope, context.Inquiry)
+	if err != nil {
+		return &context, err
+	}
+	prompt, schema, err := client.render("reason", context, relevant, examples)
+	if err != nil {
+		return &context, err
+	}
+	if len(tools) > 0 && schema != nil {
+		schema = enlist(schema, tools)
+	}
+
+	var messages []Message
+	messages = append(messages, Message{Role: "system", Content: prompt})
+	for _, example := range examples {
+		messages = append(messages, Message{Role: "user", Content: example.Inquiry})
+		fields := map[string]string{
+			"tool":        example.Tool,
+			"thought":     example.Thought,
+			"keyphrases":  example.Keyphrases,
+			"observation": example.Observation,
+			"topic":       example.Topic,
+		}
+		if len(tools) > 0 {
+			// required by the schema extended with the tools
+			fields["arguments"] = example.Arguments
+		}
+		messages = append(messages, Message{Role: "assistant", Content: client.construct(fields)})
+	}
+	for _, msg := range relevant {
+		messages = append(messages, Message{Role: "user", Content: msg.Inquiry})
+		fields := map[string]string{
+			"tool":        "Google",
+			"thought":     msg.Thought,
+			"keyphrases":  msg.Keyphrases,
+			"observation": msg.Answer,
+			"topic":       msg.Topic,
+		}
+		if len(tools) > 0 {
+			fields["arguments"] = ""
+		}
+		messages = append(messages, Message{Role: "assistant", Content: client.construct(fields)})
+	}
 
-	args := os.Args[1:]
-	for _, arg := range args {
-		evaluate(arg)
+	inquiry := context.Inquiry
+	messages = append(messages, Message{Role: "user", Content: inquiry})
+	hint := ""
+	if schema == nil {
+		hint = "tool: Google\nthought: "
+		if len(tools) > 0 {
+			hint = "tool: "
+		}
+		messages = append(messages, Message{Role: "assistant", Content: hint})
+	}
+	completion, usage, validation, err := client.conform("Reason", context, messages, schema, nil)
+	if err != nil {
+		return &context, err
+	}
+	result, flaws := client.breakdown(hint, completion)
+	if schema == nil && (result["keyphrases"] == "" || len(result["keyphrases"]) == 0) {
+		if client.DebugChat {
+			fmt.Fprintln(client.Output, "--> Invalid keyphrases. Trying again...")
+		}
+		hint = "tool: Google\nthought: " + result["thought"] + "\nkeyphrases: "
+		if len(tools) > 0 {
+			hint = "tool: " + result["tool"] + "\narguments: " + result["arguments"] + "\nthought: " + result["thought"] + "\nkeyphrases: "
+		}
+		messages = messages[:len(messages)-1]
+		messages = append(messages, Message{Role: "assistant", Content: hint})
+		var retry Usage
+		completion, retry, err = client.converse("Reason", context, messages, schema, nil)
+		if err != nil {
+			return &context, err
+		}
+		result, flaws = client.breakdown(hint, completion)
+		usage.PromptTokens += retry.PromptTokens
+		usage.CompletionTokens += retry.CompletionTokens
+	}
+	topic := result["topic"]
+	thought := result["thought"]
+	keyphrases := result["keyphrases"]
+	observation := result["observation"]
+	fields := map[string]interface{}{
+		"topic":             topic,
+		"thought":           thought,
+		"keyphrases":        keyphrases,
+		"observation":       observation,
+		"prompt_tokens":     usage.PromptTokens,
+		"completion_tokens": usage.CompletionTokens,
+	}
+	for key, value := range validation {
+		fields[key] = value
+	}
+	if len(flaws) > 0 && validation == nil {
+		// without a schema, the text output is checked only here, where it is patched
+		fields["valid"] = false
+		fields["violations"] = flaws
+	}
+	if len(tools) > 0 {
+		if outcome, used := client.wield(tools, result["tool"], result["arguments"]); used {
+			observation = outcome
+		}
+		fields["tool"] = result["tool"]
+		fields["arguments"] = result["arguments"]
+		fields["observation"] = observation
+	}
+	if delegates.Leave != nil {
+		delegates.Leave("Reason", fields)
+	}
+
+	context.Topic = topic
+	context.Thought = thought
+	context.Keyphrases = keyphrases
+	context.Observation = observation
+	return &context, nil
+}
+
+// Respond responds to the user's recent message using an LLM.
+// The response from the LLM is available as `answer` in the updated context.
+func (client *Client) Respond(context Context) (*Context, error) {
+	history := context.History
+	delegates := context.Delegates
+
+	if delegates.Enter != nil {
+		delegates.Enter("Respond")
+	}
+
+	relevant := history
+	if len(history) >= 2 {
+		relevant = history[len(history)-2:]
+	}
+	prompt, schema, err := client.render("respond", context, relevant, nil)
+	if err != nil {
+		return &context, err
+	}
+
+	var messages []Message
+	messages = append(messages, Message{Role: "system", Content: prompt})
+	inquiry := context.Inquiry
+	observation := context.Observation
+	messages = append(messages, Message{Role: "user", Content: client.construct(map[string]string{"inquiry": inquiry, "observation": observation})})
+	if schema == nil {
+		messages = append(messages, Message{Role: "assistant", Content: "Answer: "})
+	}
+	completion, usage, validation, err := client.conform("Respond", context, messages, schema, delegates.Stream)
+	if err != nil {
+		return &context, err
+	}
+	answer := completion
+	if schema != nil {
+		result, _ := client.breakdown("", completion)
+		answer = result["answer"]
+	}
+	if repairs, _ := validation["repairs"].(int); repairs > 0 && delegates.Stream != nil && delegates.Revise != nil {
+		// only the invalid answer was streamed
+		delegates.Revise(answer)
+	}
+
+	if delegates.Leave != nil {
+		fields := map[string]interface{}{
+			"inquiry":           inquiry,
+			"observation":       observation,
+			"answer":            answer,
+			"prompt_tokens":     usage.PromptTokens,
+			"completion_tokens": usage.CompletionTokens,
+		}
+		for key, value := range validation {
+			fields[key] = value
+		}
+		delegates.Leave("Respond", fields)
+	}
+
+	context.Answer = answer
+	return &context, nil
+}
+
+// UnmarshalJSON decodes the assertions while preserving their order.
+func (assertions *Assertions) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return fmt.Errorf("assertions must be an object: %s", data)
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		role := token.(string)
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return err
+		}
+		var expectations []string
+		var expectation string
+		if err := json.Unmarshal(value, &expectation); err == nil {
+			expectations = []string{expectation}
+		} else if err := json.Unmarshal(value, &expectations); err != nil {
+			return fmt.Errorf("invalid expectation for %s: %s", role, value)
+		}
+		for _, expected := range expectations {
+			*assertions = append(*assertions, Assertion{Role: role, Expected: expected})
+		}
+	}
+	return nil
+}
+
+// structured parses a test file in the structured format, i.e. JSON Lines with one story per line.
+func structured(filename string) ([]Story, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var stories []Story
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	number := 0
+	for scanner.Scan() {
+		number++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "//") {
+			continue
+		}
+		var story Story
+		if err := json.Unmarshal([]byte(line), &story); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, number, err)
+		}
+		if story.Pipeline != "" && story.Pipeline != "zero-shot" && story.Pipeline != "chain-of-thought" {
+			return nil, fmt.Errorf("%s:%d: unknown pipeline %s", filename, number, story.Pipeline)
+		}
+		if story.Timeout != "" {
+			if _, err := time.ParseDuration(story.Timeout); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", filename, number, err)
+			}
+		}
+		stories = append(stories, story)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return stories, nil
+}
+
+// load parses a test file into a list of stories. A file with the .jsonl extension is
+// in the structured format, otherwise it is in the line-based format.
+func load(filename string) ([]Story, error) {
+	if strings.HasSuffix(strings.ToLower(filename), ".jsonl") {
+		return structured(filename)
+	}
+
+	// A comment starts with # at the beginning of a line or after a whitespace, so that e.g. "C#" is preserved.
+	trim := func(input string) string {
+		text := strings.TrimSpace(input)
+		marker := regexp.MustCompile(`(^|\s)#`).FindStringIndex(text)
+		if marker != nil {
+			return strings.TrimSpace(text[:marker[0]])
+		}
+		return text
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stories := []Story{{}}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		parts := strings.SplitN(trim(line), ":", 2)
+		if len(parts) < 2 {
+			continue
+		}
+		role := parts[0]
+		content := strings.TrimSpace(parts[1])
+		story := &stories[len(stories)-1]
+
+		if role == "Story" {
+			var tags []string
+			if marker := regexp.MustCompile(`#\s*tags:(.*)$`).FindStringSubmatch(line); marker != nil {
+				for _, tag := range strings.Split(marker[1], ",") {
+					if tag = strings.TrimSpace(tag); len(tag) > 0 {
+						tags = append(tags, tag)
+					}
+				}
+			}
+			stories = append(stories, Story{Name: content, Tags: tags})
+		} else if role == "User" {
+			story.Turns = append(story.Turns, Turn{Inquiry: content})
+		} else {
+			if len(story.Turns) == 0 {
+				return nil, fmt.Errorf("there is no answer yet for %s", role)
+			}
+			turn := &story.Turns[len(story.Turns)-1]
+			turn.Assertions = append(turn.Assertions, Assertion{Role: role, Expected: content})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return stories, nil
+}
+
+// deadline runs the pipeline, but gives up if it does not complete within the timeout (if any).
+// On a timeout, the requests to the LLM are cancelled and the pipeline is waited for, so that
+// nothing runs in the background afterwards. The returned flag indicates whether the pipeline has completed.
+func deadline(pipeline Pipeline, context Context, timeout time.Duration) (*Context, bool, error) {
+	if timeout <= 0 {
+		result, err := pipeline(context)
+		return result, true, err
+	}
+
+	parent := context.Scope
+	if parent == nil {
+		parent = gocontext.Background()
+	}
+	scope, cancel := gocontext.WithCancel(parent)
+	defer cancel()
+	context.Scope = scope
+
+	type Completion struct {
+		result *Context
+		err    error
+	}
+	done := make(chan Completion, 1)
+	go func() {
+		result, err := pipeline(context)
+		done <- Completion{result, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case completion := <-done:
+		return completion.result, true, completion.err
+	case <-timer.C:
+		cancel()
+		<-done
+		return nil, false, fmt.Errorf("timed out after %s", timeout)
+	}
+}
+
+// Identify returns the unique key of a turn, from the (normalized) path of the test file and
+// the positions of the story and the turn, so that stories and inquiries may share the same text.
+func Identify(file string, story, turn int) string {
+	return fmt.Sprintf("%s#%d.%d", filepath.ToSlash(filepath.Clean(file)), story, turn)
+}
+
+// pick returns only the stories and the turns selected by the filter. In a story, the turns
+// preceding a selected turn are still run (silently) to build the conversation history.
+func pick(stories []Story, filename string, filter Filter) []Story {
+	tagged := func(story Story) bool {
+		if len(filter.Tags) == 0 {
+			return true
+		}
+		for _, tag := range story.Tags {
+			for _, wanted := range filter.Tags {
+				if strings.EqualFold(tag, strings.TrimSpace(wanted)) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	var picked []Story
+	for position, story := range stories {
+		story.Index = position
+		if filter.Story != nil && !filter.Story.MatchString(story.Name) {
+			continue
+		}
+		if !tagged(story) {
+			continue
+		}
+		var turns []Turn
+		last := -1
+		for index, turn := range story.Turns {
+			turn.Index = index
+			selected := true
+			if filter.Grep != nil && !filter.Grep.MatchString(turn.Inquiry) {
+				selected = false
+			}
+			if filter.Failed != nil && !filter.Failed[Identify(filename, story.Index, turn.Index)] {
+				selected = false
+			}
+			turn.Silent = !selected
+			if selected {
+				last = index
+			}
+			turns = append(turns, turn)
+		}
+		if last >= 0 {
+			story.Turns = turns[:last+1]
+			picked = append(picked, story)
+		}
+	}
+	return picked
+}
+
+// Evaluate evaluates a test file and executes the test cases, every story is run repeatedly.
+// The progress is printed to Client.Output. An error, e.g. an unknown role, stops the evaluation.
+func (client *Client) Evaluate(filename string, repeat int, filter Filter) ([]Question, error) {
+	stories, err := load(filename)
+	if err != nil {
+		return nil, err
+	}
+	stories = pick(stories, filename, filter)
+
+	var questions []Question
+	for _, story := range stories {
+		for _, turn := range story.Turns {
+			if turn.Silent {
+				continue
+			}
+			questions = append(questions, Question{
+				File:       filename,
+				Story:      story.Name,
+				StoryIndex: story.Index,
+				TurnIndex:  turn.Index,
+				Tags:       story.Tags,
+				Metadata:   story.Metadata,
+				Inquiry:    turn.Inquiry,
+			})
+		}
+	}
+	total := 0
+	failures := 0
+	var checks []Check
+
+	// assess checks the assertion against the most recent turn, and returns the reason in case of a failure.
+	assess := func(assertion Assertion, last History, zeroShot bool) (string, error) {
+		role := assertion.Role
+		content := assertion.Expected
+		inquiry := last.Inquiry
+		duration := last.Duration
+		stages := last.Stages
+
+		if role == "Assistant" || strings.HasPrefix(role, "Assistant.") {
+			target := last.Answer
+			matcher := strings.TrimPrefix(strings.TrimPrefix(role, "Assistant"), ".")
+			var verdict Verdict
+			var err error
+			if matcher == "MaxLatency" {
+				verdict, err = latency(duration, content)
+			} else if reported := answering(stages).CompletionTokens; matcher == "MaxTokens" && reported > 0 {
+				// the same completion tokens as counted in the reports, estimated only when the service reports none
+				verdict, err = quantify(reported, "token(s)", target, "<= "+content)
+			} else {
+				verdict, err = client.verify(matcher, target, content)
+			}
+			if err != nil {
+				return "", err
+			}
+			checks = append(checks, Check{Role: role, Verdict: verdict})
+
+			if verdict.Passed {
+				if matcher == "" {
+					fmt.Fprintf(client.Output, "%s%s %s%s %s[%d ms]%s\n", GREEN, CHECK, CYAN, inquiry, GRAY, duration, NORMAL)
+					fmt.Fprintln(client.Output, " ", verdict.Actual)
+					if client.DebugPipeline {
+						client.review(simplify(stages))
+					}
+				} else {
+					fmt.Fprintf(client.Output, "%s    %s %s: %s\n", GRAY, ARROW, role, verdict.Actual)
+				}
+				return "", nil
+			}
+			fmt.Fprintf(client.Output, "%s%s %s%s %s[%d ms]%s\n", RED, CROSS, YELLOW, inquiry, GRAY, duration, NORMAL)
+			fmt.Fprintf(client.Output, "Expected %s %s\n", role, verdict.Expectation)
+			fmt.Fprintf(client.Output, "Actual %s: %s\n", role, verdict.Actual)
+			return plain(fmt.Sprintf("Expected %s %s, actual: %s", role, verdict.Expectation, verdict.Actual)), nil
+
+		} else if role == "Pipeline.Language" {
+			// only recorded by the Detect stage, i.e. with a language configured for the story or the client
+			target, exists := inspect(simplify(stages), "Detect", "language")
+			if !exists {
+				checks = append(checks, Check{Role: role, Verdict: Verdict{Expectation: "to be recorded by the Detect stage"}})
+				fmt.Fprintf(client.Output, "%sExpected %s to be recorded by the Detect stage (set the language, e.g. auto)%s\n", RED, role, NORMAL)
+				return fmt.Sprintf("Expected %s to be recorded by the Detect stage", role), nil
+			}
+			verdict, err := client.verify("", target, content)
+			if err != nil {
+				return "", err
+			}
+			checks = append(checks, Check{Role: role, Verdict: verdict})
+			if verdict.Passed {
+				fmt.Fprintf(client.Output, "%s    %s %s: %s\n", GRAY, ARROW, role, verdict.Actual)
+				return "", nil
+			}
+			fmt.Fprintf(client.Output, "%sExpected %s %s\n", RED, role, verdict.Expectation)
+			fmt.Fprintf(client.Output, "%sActual %s: %s\n", RED, role, verdict.Actual)
+			return plain(fmt.Sprintf("Expected %s %s, actual: %s", role, verdict.Expectation, verdict.Actual)), nil
+
+		} else if !zeroShot {
+			parts := strings.Split(role, ".")
+			if parts[0] != "Pipeline" || (len(parts) != 3 && len(parts) != 4) {
+				return "", fmt.Errorf("unknown role: %s", role)
+			}
+			matcher := ""
+			if len(parts) == 4 {
+				matcher = parts[3]
+			}
+			target, exists := inspect(simplify(stages), parts[1], parts[2])
+			if !exists {
+				checks = append(checks, Check{Role: role, Verdict: Verdict{Expectation: "to be recorded in the pipeline"}})
+				fmt.Fprintf(client.Output, "%sExpected %s to be recorded in the pipeline%s\n", RED, role, NORMAL)
+				return fmt.Sprintf("Expected %s to be recorded in the pipeline", role), nil
+			}
+			verdict, err := client.verify(matcher, target, content)
+			if err != nil {
+				return "", err
+			}
+			checks = append(checks, Check{Role: role, Verdict: verdict})
+			if verdict.Passed {
+				fmt.Fprintf(client.Output, "%s    %s %s: %s\n", GRAY, ARROW, role, verdict.Actual)
+				return "", nil
+			}
+			fmt.Fprintf(client.Output, "%sExpected %s %s\n", RED, role, verdict.Expectation)
+			fmt.Fprintf(client.Output, "%sActual %s: %s\n", RED, role, verdict.Actual)
+			return plain(fmt.Sprintf("Expected %s %s, actual: %s", role, verdict.Expectation, verdict.Actual)), nil
+		}
+		return "", nil
+	}
+
+	for run := 1; run <= repeat; run++ {
+		if repeat > 1 {
+			fmt.Fprintln(client.Output)
+			fmt.Fprintf(client.Output, "%sRun #%d of %d%s\n", BOLD, run, repeat, NORMAL)
+		}
+		index := 0
+		for _, story := range stories {
+			if story.Name != "" {
+				fmt.Fprintln(client.Output)
+				fmt.Fprintln(client.Output, "-----------------------------------")
+				fmt.Fprintf(client.Output, "Story: %s%s%s%s\n", MAGENTA, BOLD, story.Name, NORMAL)
+				fmt.Fprintln(client.Output, "-----------------------------------")
+			}
+			history := make([]History, 0)
+
+			config := client.Config
+			if story.Model != "" {
+				config.ChatModel = story.Model
+				fmt.Fprintf(client.Output, "%sUsing model %s%s\n", GRAY, story.Model, NORMAL)
+			}
+			if story.Language != "" {
+				config.Language = story.Language
+			}
+			runner := client.adapt(config)
+			zeroShot := client.ZeroShot
+			if story.Pipeline != "" {
+				zeroShot = story.Pipeline == "zero-shot"
+			}
+			timeout, _ := time.ParseDuration(story.Timeout)
+			spent := Usage{}
+			var charged []Record
+
+			for _, turn := range story.Turns {
+				inquiry := turn.Inquiry
+				stages := make([]Stage, 0)
+				enter := func(name string) {
+					stages = append(stages, Stage{Name: name, Timestamp: time.Now().UnixNano() / int64(time.Millisecond)})
+				}
+				leave := func(name string, fields map[string]interface{}) {
+					stages = append(stages, Stage{Name: name, Timestamp: time.Now().UnixNano() / int64(time.Millisecond), Fields: fields})
+				}
+
+				delegates, finish := runner.instrument(inquiry, Delegates{
+					Enter: enter,
+					Leave: leave,
+				})
+				var exchanges []Record
+				delegates, record := runner.journal(Record{File: filename, Story: story.Name, Inquiry: inquiry}, delegates, func(entry Record) {
+					if entry.Type == "chat" {
+						exchanges = append(exchanges, entry)
+					}
+				})
+				context := Context{
+					Inquiry:   inquiry,
+					History:   history,
+					Delegates: delegates,
+				}
+				fmt.Fprintf(client.Output, "  %s\r", inquiry)
+				start := time.Now()
+				pipeline := runner.assemble(zeroShot)
+				result, completed, err := deadline(pipeline, context, timeout)
+				duration := time.Since(start).Milliseconds()
+				finish(result, err)
+				if err != nil {
+					result = &Context{}
+				}
+				var trail []Stage
+				var calls []Record
+				if completed {
+					trail = stages
+					calls = exchanges
+				}
+
+				last := History{
+					Inquiry:    inquiry,
+					Thought:    result.Thought,
+					Keyphrases: result.Keyphrases,
+					Topic:      result.Topic,
+					Answer:     result.Answer,
+					Duration:   duration,
+					Stages:     trail,
+				}
+				history = append(history, last)
+				entry := Record{Answer: last.Answer, Stages: simplify(trail), Duration: duration}
+				if err != nil {
+					entry.Error = err.Error()
+				}
+				// the pipeline has been waited for, so even a timed-out turn has its tokens recorded
+				usage := consumption(simplify(stages))
+				spent.PromptTokens += usage.PromptTokens
+				spent.CompletionTokens += usage.CompletionTokens
+				charged = append(charged, exchanges...)
+				if turn.Silent {
+					record(entry)
+					fmt.Fprintf(client.Output, "%s  %s %s [%d ms]%s\n", GRAY, ARROW, inquiry, duration, NORMAL)
+					continue
+				}
+				question := &questions[index]
+				index++
+				total++
+
+				outcome := Outcome{
+					Model:            runner.ChatModel,
+					Answer:           last.Answer,
+					Keyphrases:       last.Keyphrases,
+					Topic:            last.Topic,
+					Duration:         duration,
+					PromptTokens:     usage.PromptTokens,
+					CompletionTokens: usage.CompletionTokens,
+					Stages:           simplify(trail),
+					Exchanges:        calls,
+				}
+				checks = nil
+				if err != nil {
+					failures++
+					fmt.Fprintf(client.Output, "%s%s %s%s %s[%d ms]%s\n", RED, CROSS, YELLOW, inquiry, GRAY, duration, NORMAL)
+					fmt.Fprintln(client.Output, "ERROR:", err)
+					outcome.Failures = append(outcome.Failures, err.Error())
+				} else {
+					for _, assertion := range turn.Assertions {
+						failure, err := assess(assertion, last, zeroShot)
+						if err != nil {
+							return nil, fmt.Errorf("%s: %s: %w", filename, inquiry, err)
+						}
+						if failure != "" {
+							failures++
+							outcome.Failures = append(outcome.Failures, failure)
+							client.review(simplify(trail))
+							if client.DebugFailExit {
+								return nil, fmt.Errorf("%s: %s: stopped at the first failure", filename, inquiry)
+							}
+						}
+					}
+				}
+				outcome.Passed = len(outcome.Failures) == 0
+				outcome.Checks = checks
+				entry.Passed = &outcome.Passed
+				entry.Failures = outcome.Failures
+				record(entry)
+
+				question.Outcomes = append(question.Outcomes, outcome)
+				question.Runs++
+				if outcome.Passed {
+					question.Passes++
+				}
+			}
+			if spent.PromptTokens+spent.CompletionTokens > 0 {
+				fmt.Fprintf(client.Output, "%sTokens for this story: %s%s\n", GRAY, runner.expense(spent, runner.ChatModel, charged), NORMAL)
+			}
+		}
+	}
+
+	for i := range questions {
+		question := &questions[i]
+		question.PassRate = float64(question.Passes) / float64(question.Runs)
+		if question.Passes == question.Runs {
+			question.Status = "pass"
+		} else if question.Passes == 0 {
+			question.Status = "fail"
+		} else {
+			question.Status = "flaky"
+		}
+	}
+
+	if failures <= 0 {
+		fmt.Fprintf(client.Output, "%s%s%s SUCCESS: %s%d test(s)%s.\n", GREEN, CHECK, NORMAL, GREEN, total, NORMAL)
+	} else {
+		fmt.Fprintf(client.Output, "%s%s%s FAIL: %s%d test(s), %s%d failure(s)%s.\n", RED, CROSS, NORMAL, GRAY, total, RED, failures, NORMAL)
+	}
+	if repeat > 1 {
+		client.tally(questions, repeat)
+	}
+	return questions, nil
+}
+
+// passAtK estimates the probability that at least one of k samples passes,
+// given c passing samples out of n, using the unbiased estimator 1 - C(n-c, k) / C(n, k).
+func passAtK(n, c, k int) float64 {
+	if n-c < k {
+		return 1
+	}
+	product := 1.0
+	for i := n - c + 1; i <= n; i++ {
+		product *= 1 - float64(k)/float64(i)
+	}
+	return 1 - product
+}
+
+// tally prints the statistics of repeated runs, and marks flaky questions separately from failing ones.
+func (client *Client) tally(questions []Question, repeat int) {
+	report := client.Summarize(questions, repeat)
+	passes := 0
+	runs := 0
+	for _, question := range questions {
+		passes += question.Passes
+		runs += question.Runs
+	}
+	if runs == 0 {
+		return
+	}
+	fmt.Fprintf(client.Output, "%sPass rate: %.1f%% (%d of %d runs), pass@1: %.2f, pass@%d: %.2f%s\n",
+		GRAY, 100*float64(passes)/float64(runs), passes, runs, report.PassAt1, repeat, report.PassAtK, NORMAL)
+
+	for _, question := range questions {
+		if question.Status == "flaky" {
+			fmt.Fprintf(client.Output, "%s~ Flaky%s %s %s[%d/%d passed]%s\n", YELLOW, NORMAL, question.Inquiry, GRAY, question.Passes, question.Runs, NORMAL)
+		}
+	}
+	for _, question := range questions {
+		if question.Status == "fail" {
+			fmt.Fprintf(client.Output, "%s%s Failing%s %s %s[%d/%d passed]%s\n", RED, CROSS, NORMAL, question.Inquiry, GRAY, question.Passes, question.Runs, NORMAL)
+		}
+	}
+}
+
+// Ask answers the inquiry using the configured pipeline, possibly continuing the conversation in the history.
+// The answer is streamed into the handler, if any, and replaced through revise if it had to be repaired.
+// The returned turn also records every stage of the pipeline.
+func (client *Client) Ask(inquiry string, history []History, handler func(string), revise func(string)) (History, error) {
+	return client.ask(gocontext.Background(), inquiry, history, handler, revise)
+}
+
+// ask is Ask within the scope, which cancels the requests to the LLM once done, e.g. as the HTTP client disconnects.
+func (client *Client) ask(scope gocontext.Context, inquiry string, history []History, handler func(string), revise func(string)) (History, error) {
+	stages := []Stage{}
+	enter := func(name string) {
+		stages = append(stages, Stage{Name: name, Timestamp: time.Now().UnixNano() / int64(time.Millisecond)})
+	}
+	leave := func(name string, fields map[string]interface{}) {
+		stages = append(stages, Stage{Name: name, Timestamp: time.Now().UnixNano() / int64(time.Millisecond), Fields: fields})
+	}
+	var stream func(string)
+	if handler != nil {
+		stream = client.unwrap(handler)
+	}
+
+	delegates, finish := client.instrument(inquiry, Delegates{Stream: stream, Revise: revise, Enter: enter, Leave: leave})
+	delegates, record := client.journal(Record{Inquiry: inquiry}, delegates)
+	context := Context{Inquiry: inquiry, History: history, Delegates: delegates, Scope: scope}
+	start := time.Now()
+	result, err := client.Pipeline()(context)
+	duration := time.Since(start).Milliseconds()
+	finish(result, err)
+	if err != nil {
+		record(Record{Stages: simplify(stages), Duration: duration, Error: err.Error()})
+		return History{Inquiry: inquiry, Duration: duration, Stages: stages}, err
+	}
+	record(Record{Answer: result.Answer, Stages: simplify(stages), Duration: duration})
+
+	return History{
+		Inquiry:     inquiry,
+		Thought:     result.Thought,
+		Keyphrases:  result.Keyphrases,
+		Topic:       result.Topic,
+		Observation: result.Observation,
+		Answer:      result.Answer,
+		Duration:    duration,
+		Stages:      stages,
+	}, nil
+}
+
+// Interact runs the question-answering session in the terminal, with the inquiries read from the reader
+// (usually stdin) until its end, and the answers printed to Client.Output. It stops at the first error.
+func (client *Client) Interact(reader io.Reader, reviewFile string) error {
+	history := make([]History, 0)
+	var questions []Question
+	var failure error
+	loop := true
+	scanner := bufio.NewScanner(reader)
+
+	var qa func()
+	qa = func() {
+		fmt.Fprint(client.Output, YELLOW+">> "+CYAN)
+		if !scanner.Scan() {
+			loop = false
+			return
+		}
+		inquiry := scanner.Text()
+		fmt.Fprint(client.Output, NORMAL)
+		if inquiry == "!review" || inquiry == "/review" {
+			if len(history) == 0 {
+				fmt.Fprintln(client.Output, "Nothing to review yet!")
+				fmt.Fprintln(client.Output)
+			} else {
+				last := history[len(history)-1]
+				stages := last.Stages
+				client.review(simplify(stages))
+			}
+		} else {
+			stream := client.unwrap(func(text string) {
+				fmt.Fprint(client.Output, text)
+			})
+			revise := func(answer string) {
+				fmt.Fprintf(client.Output, "\n%s%s Repaired answer:%s\n%s", GRAY, ARROW, NORMAL, answer)
+			}
+
+			stages := []Stage{}
+			update := func(stage string, fields map[string]interface{}) {
+				if stage == "Reason" {
+					keyphrases := fields["keyphrases"].(string)
+					if len(keyphrases) > 0 {
+						fmt.Fprintf(client.Output, "%s%s Searching for %s...%s\n", GRAY, ARROW, keyphrases, NORMAL)
+					}
+				}
+			}
+			enter := func(name string) {
+				stages = append(stages, Stage{Name: name, Timestamp: time.Now().UnixNano() / int64(time.Millisecond)})
+			}
+			leave := func(name string, fields map[string]interface{}) {
+				update(name, fields)
+				stages = append(stages, Stage{Name: name, Timestamp: time.Now().UnixNano() / int64(time.Millisecond), Fields: fields})
+			}
+			delegates, finish := client.instrument(inquiry, Delegates{Stream: stream, Revise: revise, Enter: enter, Leave: leave})
+			var exchanges []Record
+			delegates, record := client.journal(Record{Inquiry: inquiry}, delegates, func(entry Record) {
+				if entry.Type == "chat" && reviewFile != "" {
+					exchanges = append(exchanges, entry)
+				}
+			})
+			context := Context{Inquiry: inquiry, History: history, Delegates: delegates}
+			start := time.Now()
+			result, err := client.Pipeline()(context)
+			duration := time.Since(start).Milliseconds()
+			finish(result, err)
+			if err != nil {
+				record(Record{Stages: simplify(stages), Duration: duration, Error: err.Error()})
+				failure = err
+				loop = false
+				return
+			}
+			record(Record{Answer: result.Answer, Stages: simplify(stages), Duration: duration})
+			if reviewFile != "" {
+				usage := consumption(simplify(stages))
+				questions = append(questions, Question{
+					Inquiry: inquiry,
+					Outcomes: []Outcome{{
+						Answer:           result.Answer,
+						Duration:         duration,
+						PromptTokens:     usage.PromptTokens,
+						CompletionTokens: usage.CompletionTokens,
+						Passed:           true,
+						Stages:           simplify(stages),
+						Exchanges:        exchanges,
+					}},
+				})
+				if err := client.ExportReview(questions, reviewFile); err != nil {
+					fmt.Fprintln(client.Output, "ERROR:", err)
+				}
+			}
+			history = append(history, History{
+				Inquiry:    inquiry,
+				Thought:    result.Thought,
+				Keyphrases: result.Keyphrases,
+				Topic:      result.Topic,
+				Answer:     result.Answer,
+				Duration:   duration,
+				Stages:     stages,
+			})
+			fmt.Fprintln(client.Output)
+		}
+		if loop {
+			qa()
+		}
+	}
+	qa()
+	if failure != nil {
+		return failure
+	}
+	return scanner.Err()
+}
+
+// Serve exposes the pipeline as an OpenAI-compatible model at the address (see Handler).
+func (client *Client) Serve(address string) error {
+	fmt.Fprintf(client.Output, "Serving the pipeline on %s%s%s\n", GREEN, address, NORMAL)
+	server := &http.Server{Addr: address, Handler: client.Handler()}
+	return server.ListenAndServe()
+}
+
+// Handler returns the HTTP handler exposing the pipeline as an OpenAI-compatible model, via `/v1/chat/completions`
+// and `/v1/models`, e.g. to be mounted by another server. The earlier exchanges become the history of the conversation,
+// the last user message becomes the inquiry. Setting `query_llm.stages` in the request adds the data of every
+// pipeline stage to the response. With Config.JSONSchema, a streamed answer is sent only once validated (and
+// possibly repaired), since the clients could not replace the content already streamed.
+func (client *Client) Handler() http.Handler {
+	const model = "query-llm"
+
+	type Incoming struct {
+		Role    string      `json:"role"`
+		Content interface{} `json:"content"`
+	}
+	type CompletionRequest struct {
+		Model         string         `json:"model"`
+		Messages      []Incoming     `json:"messages"`
+		Stream        bool           `json:"stream"`
+		StreamOptions *StreamOptions `json:"stream_options"`
+		Extension     *struct {
+			Stages bool `json:"stages"`
+		} `json:"query_llm"`
+	}
+
+	// text flattens the message content, either a string or an array of content parts.
+	text := func(content interface{}) string {
+		switch value := content.(type) {
+		case string:
+			return value
+		case []interface{}:
+			var texts []string
+			for _, part := range value {
+				if object, ok := part.(map[string]interface{}); ok && object["type"] == "text" {
+					texts = append(texts, fmt.Sprintf("%v", object["text"]))
+				}
+			}
+			return strings.Join(texts, "\n")
+		}
+		return ""
+	}
+
+	failure := func(w http.ResponseWriter, status int, message string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": map[string]interface{}{
+				"message": message,
+				"type":    http.StatusText(status),
+			},
+		})
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/models", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"object": "list",
+			"data": []interface{}{
+				map[string]interface{}{
+					"id":       model,
+					"object":   "model",
+					"created":  time.Now().Unix(),
+					"owned_by": client.ChatModel,
+				},
+			},
+		})
+	})
+
+	mux.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			failure(w, http.StatusMethodNotAllowed, "only POST is supported")
+			return
+		}
+		var request CompletionRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			failure(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		history := make([]History, 0)
+		inquiry := ""
+		for _, message := range request.Messages {
+			switch message.Role {
+			case "user":
+				if inquiry != "" {
+					history = append(history, History{Inquiry: inquiry})
+				}
+				inquiry = text(message.Content)
+			case "assistant":
+				if inquiry != "" {
+					history = append(history, History{Inquiry: inquiry, Answer: text(message.Content)})
+					inquiry = ""
+				}
+			}
+		}
+		if inquiry == "" {
+			failure(w, http.StatusBadRequest, "the last message must be from the user")
+			return
+		}
+
+		id := "chatcmpl-" + identifier(12)
+		created := time.Now().Unix()
+		flusher, streaming := w.(http.Flusher)
+		streaming = streaming && request.Stream
+		send := func(object interface{}) {
+			jsonData, _ := json.Marshal(object)
+			fmt.Fprintf(w, "data: %s\n\n", jsonData)
+			flusher.Flush()
+		}
+		chunk := func(delta map[string]interface{}, finish interface{}) map[string]interface{} {
+			return map[string]interface{}{
+				"id":      id,
+				"object":  "chat.completion.chunk",
+				"created": created,
+				"model":   model,
+				"choices": []interface{}{
+					map[string]interface{}{"index": 0, "delta": delta, "finish_reason": finish},
+				},
+			}
+		}
+
+		var stream func(string)
+		if streaming {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			send(chunk(map[string]interface{}{"role": "assistant", "content": ""}, nil))
+			if !client.JSONSchema {
+				stream = func(partial string) {
+					if partial == "" {
+						return
+					}
+					send(chunk(map[string]interface{}{"content": partial}, nil))
+				}
+			}
+		}
+
+		turn, err := client.ask(r.Context(), inquiry, history, stream, nil)
+		stages := simplify(turn.Stages)
+		if err != nil {
+			if streaming {
+				send(map[string]interface{}{"error": map[string]interface{}{"message": err.Error()}})
+				fmt.Fprint(w, "data: [DONE]\n\n")
+				return
+			}
+			failure(w, http.StatusBadGateway, err.Error())
+			return
+		}
+
+		usage := consumption(stages)
+		counts := map[string]interface{}{
+			"prompt_tokens":     usage.PromptTokens,
+			"completion_tokens": usage.CompletionTokens,
+			"total_tokens":      usage.PromptTokens + usage.CompletionTokens,
+		}
+		var extension map[string]interface{}
+		if request.Extension != nil && request.Extension.Stages {
+			extension = map[string]interface{}{"stages": stages}
+		}
+
+		if streaming {
+			if stream == nil {
+				send(chunk(map[string]interface{}{"content": turn.Answer}, nil))
+			}
+			last := chunk(map[string]interface{}{}, "stop")
+			if extension != nil {
+				last["query_llm"] = extension
+			}
+			send(last)
+			if request.StreamOptions != nil && request.StreamOptions.IncludeUsage {
+				send(map[string]interface{}{
+					"id":      id,
+					"object":  "chat.completion.chunk",
+					"created": created,
+					"model":   model,
+					"choices": []interface{}{},
+					"usage":   counts,
+				})
+			}
+			fmt.Fprint(w, "data: [DONE]\n\n")
+			flusher.Flush()
+			return
+		}
+
+		response := map[string]interface{}{
+			"id":      id,
+			"object":  "chat.completion",
+			"created": created,
+			"model":   model,
+			"choices": []interface{}{
+				map[string]interface{}{
+					"index":         0,
+					"message":       map[string]interface{}{"role": "assistant", "content": turn.Answer},
+					"finish_reason": "stop",
+				},
+			},
+			"usage": counts,
+		}
+		if extension != nil {
+			response["query_llm"] = extension
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+	return mux
+}
+
+// MCP serves the Model Context Protocol over a pair of streams, usually stdin and stdout, offering two tools:
+// `ask` to run the pipeline, and `evaluate` to run a test file. Since the output stream carries the protocol,
+// Client.Output (e.g. the progress of the evaluation) must be somewhere else, e.g. stderr.
+func (client *Client) MCP(reader io.Reader, writer io.Writer) error {
+	const protocol = "2024-11-05"
+	notFound := errors.New("method not found")
+	name := "chain-of-thought"
+	if client.ZeroShot {
+		name = "zero-shot"
+	}
+
+	type Request struct {
+		Version string          `json:"jsonrpc"`
+		ID      json.RawMessage `json:"id,omitempty"`
+		Method  string          `json:"method"`
+		Params  json.RawMessage `json:"params,omitempty"`
+	}
+	type Call struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+
+	tools := []interface{}{
+		map[string]interface{}{
+			"name":        "ask",
+			"description": "Answer an inquiry using the " + name + " pipeline, optionally continuing an earlier conversation.",
+			"inputSchema": map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"inquiry": map[string]interface{}{"type": "string", "description": "the question to answer"},
+					"history": map[string]interface{}{
+						"type":        "array",
+						"description": "the earlier turns of the conversation, oldest first",
+						"items": map[string]interface{}{
+							"type": "object",
+							"properties": map[string]interface{}{
+								"inquiry": map[string]interface{}{"type": "string"},
+								"answer":  map[string]interface{}{"type": "string"},
+							},
+							"required": []string{"inquiry", "answer"},
+						},
+					},
+				},
+				"required": []string{"inquiry"},
+			},
+		},
+		map[string]interface{}{
+			"name":        "evaluate",
+			"description": "Run the tests in a file and return the JSON summary of the evaluation.",
+			"inputSchema": map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"file":   map[string]interface{}{"type": "string", "description": "the path to the test file"},
+					"repeat": map[string]interface{}{"type": "integer", "description": "run every test N times", "minimum": 1},
+					"story":  map[string]interface{}{"type": "string", "description": "evaluate only the stories whose name matches the regex"},
+					"grep":   map[string]interface{}{"type": "string", "description": "evaluate only the inquiries matching the regex"},
+				},
+				"required": []string{"file"},
+			},
+		},
+	}
+
+	ask := func(arguments json.RawMessage) (interface{}, error) {
+		var input struct {
+			Inquiry string `json:"inquiry"`
+			History []struct {
+				Inquiry string `json:"inquiry"`
+				Answer  string `json:"answer"`
+			} `json:"history"`
+		}
+		if err := json.Unmarshal(arguments, &input); err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(input.Inquiry) == "" {
+			return nil, fmt.Errorf("missing inquiry")
+		}
+		history := make([]History, 0)
+		for _, turn := range input.History {
+			history = append(history, History{Inquiry: turn.Inquiry, Answer: turn.Answer})
+		}
+
+		turn, err := client.Ask(input.Inquiry, history, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		output := map[string]interface{}{"answer": turn.Answer}
+		if !client.ZeroShot {
+			output["topic"] = turn.Topic
+			output["thought"] = turn.Thought
+			output["keyphrases"] = turn.Keyphrases
+			output["observation"] = turn.Observation
+		}
+		return output, nil
+	}
+
+	evaluation := func(arguments json.RawMessage) (interface{}, error) {
+		var input struct {
+			File   string `json:"file"`
+			Repeat int    `json:"repeat"`
+			Story  string `json:"story"`
+			Grep   string `json:"grep"`
+		}
+		if err := json.Unmarshal(arguments, &input); err != nil {
+			return nil, err
+		}
+		var filter Filter
+		var err error
+		if input.Story != "" {
+			if filter.Story, err = regexp.Compile("(?i)" + input.Story); err != nil {
+				return nil, err
+			}
+		}
+		if input.Grep != "" {
+			if filter.Grep, err = regexp.Compile("(?i)" + input.Grep); err != nil {
+				return nil, err
+			}
+		}
+		if input.Repeat < 1 {
+			input.Repeat = 1
+		}
+		questions, err := client.Evaluate(input.File, input.Repeat, filter)
+		if err != nil {
+			return nil, err
+		}
+		return client.Summarize(questions, input.Repeat), nil
+	}
+
+	handle := func(request Request) (interface{}, error) {
+		switch request.Method {
+		case "initialize":
+			return map[string]interface{}{
+				"protocolVersion": protocol,
+				"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}},
+				"serverInfo":      map[string]interface{}{"name": "query-llm", "version": "1.0.0"},
+			}, nil
+		case "ping":
+			return map[string]interface{}{}, nil
+		case "tools/list":
+			return map[string]interface{}{"tools": tools}, nil
+		case "tools/call":
+			var call Call
+			if err := json.Unmarshal(request.Params, &call); err != nil {
+				return nil, err
+			}
+			var output interface{}
+			var err error
+			switch call.Name {
+			case "ask":
+				output, err = ask(call.Arguments)
+			case "evaluate":
+				output, err = evaluation(call.Arguments)
+			default:
+				return nil, fmt.Errorf("unknown tool: %s", call.Name)
+			}
+			if err != nil {
+				return map[string]interface{}{
+					"content": []interface{}{map[string]interface{}{"type": "text", "text": err.Error()}},
+					"isError": true,
+				}, nil
+			}
+			jsonData, _ := json.MarshalIndent(output, "", "  ")
+			return map[string]interface{}{
+				"content":           []interface{}{map[string]interface{}{"type": "text", "text": string(jsonData)}},
+				"structuredContent": output,
+			}, nil
+		}
+		return nil, fmt.Errorf("%w: %s", notFound, request.Method)
+	}
+
+	encoder := json.NewEncoder(writer)
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var request Request
+		if err := json.Unmarshal([]byte(line), &request); err != nil {
+			encoder.Encode(map[string]interface{}{
+				"jsonrpc": "2.0",
+				"id":      nil,
+				"error":   map[string]interface{}{"code": -32700, "message": err.Error()},
+			})
+			continue
+		}
+		if len(request.ID) == 0 {
+			// a notification, e.g. notifications/initialized, expects no response
+			continue
+		}
+		result, err := handle(request)
+		if err != nil {
+			code := -32603
+			if errors.Is(err, notFound) {
+				code = -32601
+			}
+			encoder.Encode(map[string]interface{}{
+				"jsonrpc": "2.0",
+				"id":      request.ID,
+				"error":   map[string]interface{}{"code": code, "message": err.Error()},
+			})
+			continue
+		}
+		encoder.Encode(map[string]interface{}{"jsonrpc": "2.0", "id": request.ID, "result": result})
+	}
+	return scanner.Err()
+}
+
+// Web serves the chat UI, along with the pipeline it relies on (see Serve).
+func (client *Client) Web(address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/v1/", client.Handler())
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, WEB_UI)
+	})
+	fmt.Fprintf(client.Output, "Open %shttp://%s%s in the browser.\n", GREEN, address, NORMAL)
+	server := &http.Server{Addr: address, Handler: mux}
+	return server.ListenAndServe()
+}
+
+// Recap prints the latency percentiles and the token usage of the report, e.g. of the whole test suite.
+func Recap(writer io.Writer, report Report) {
+	if report.Total == 0 {
+		return
+	}
+	fmt.Fprintf(writer, "%sLatency: p50 %d ms, p95 %d ms%s\n", GRAY, report.MedianLatency, report.P95Latency, NORMAL)
+	if report.PromptTokens+report.CompletionTokens > 0 {
+		description := fmt.Sprintf("%d prompt + %d completion", report.PromptTokens, report.CompletionTokens)
+		if report.Cost > 0 {
+			description += fmt.Sprintf(" ($%.6f)", report.Cost)
+		}
+		fmt.Fprintf(writer, "%sTokens: %s%s\n", GRAY, description, NORMAL)
+	}
+}
+
+// Summarize builds the report of every question evaluated with the current model.
+func (client *Client) Summarize(questions []Question, repeat int) Report {
+	report := Report{
+		BaseURL:   client.BaseURL,
+		Model:     client.ChatModel,
+		Repeat:    repeat,
+		Total:     len(questions),
+		Questions: questions,
+	}
+	var durations []int64
+	for _, question := range questions {
+		for _, outcome := range question.Outcomes {
+			durations = append(durations, outcome.Duration)
+			report.PromptTokens += outcome.PromptTokens
+			report.CompletionTokens += outcome.CompletionTokens
+			// every story may use another model, with its own price
+			model := outcome.Model
+			if model == "" {
+				model = client.ChatModel
+			}
+			cost, _ := client.cost(model, Usage{outcome.PromptTokens, outcome.CompletionTokens})
+			report.Cost += cost
+		}
+	}
+	report.MedianLatency = percentile(durations, 50)
+	report.P95Latency = percentile(durations, 95)
+	for _, question := range questions {
+		switch question.Status {
+		case "pass":
+			report.Passed++
+		case "flaky":
+			report.Flaky++
+		case "fail":
+			report.Failing++
+		}
+		report.PassAt1 += passAtK(question.Runs, question.Passes, 1)
+		report.PassAtK += passAtK(question.Runs, question.Passes, question.Runs)
+	}
+	if report.Total > 0 {
+		report.PassAt1 /= float64(report.Total)
+		report.PassAtK /= float64(report.Total)
+	}
+	return report
+}
+
+// percentile returns the value below which the given percentage of the values fall.
+func percentile(values []int64, percentage float64) int64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := make([]int64, len(values))
+	copy(sorted, values)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	index := int(math.Ceil(percentage/100*float64(len(sorted)))) - 1
+	if index < 0 {
+		index = 0
+	}
+	return sorted[index]
+}
+
+// Contrast evaluates the same test files against every model, specified either as
+// a model name on the current endpoint, as model@profile for the endpoint (and the API key)
+// of a profile in the config file, or as model@base-url for another endpoint which needs no key.
+func (client *Client) Contrast(models []string, files []string, repeat int) ([]Report, error) {
+	// resolve every side first, so that a wrong profile fails before any evaluation
+	var sides []*Client
+	for _, spec := range models {
+		model, endpoint, found := strings.Cut(strings.TrimSpace(spec), "@")
+		config := client.Config
+		switch {
+		case !found:
+		case strings.Contains(endpoint, "://"):
+			// never send the key of the current endpoint to another one
+			config.BaseURL = endpoint
+			config.APIKey = ""
+			config.Stages = nil
+		default:
+			profile, err := resolve(endpoint)
+			if err != nil {
+				return nil, err
+			}
+			config.Profile = profile.Profile
+			config.BaseURL = profile.BaseURL
+			config.APIKey = profile.APIKey
+			config.ChatModel = profile.ChatModel
+			config.Stages = profile.Stages
+		}
+		if model != "" {
+			config.ChatModel = model
+		}
+		sides = append(sides, client.adapt(config))
+	}
+
+	var reports []Report
+	for _, side := range sides {
+		fmt.Fprintln(side.Output)
+		fmt.Fprintf(side.Output, "Using LLM at %s (model: %s%s%s).\n", side.BaseURL, GREEN, side.ChatModel, NORMAL)
+
+		var questions []Question
+		for _, file := range files {
+			evaluated, err := side.Evaluate(file, repeat, Filter{})
+			if err != nil {
+				return nil, err
+			}
+			questions = append(questions, evaluated...)
+		}
+		reports = append(reports, side.Summarize(questions, repeat))
+	}
+	return reports, nil
+}
+
+// verdicts returns the short pass/fail notation of every question, for every report.
+func verdicts(reports []Report) [][]string {
+	var rows [][]string
+	for index := range reports[0].Questions {
+		var row []string
+		for _, report := range reports {
+			question := report.Questions[index]
+			if question.Runs == 1 {
+				row = append(row, question.Status)
+			} else {
+				row = append(row, fmt.Sprintf("%d/%d", question.Passes, question.Runs))
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// accuracy returns the percentage of the passing runs in the report.
+func accuracy(report Report) float64 {
+	passes := 0
+	runs := 0
+	for _, question := range report.Questions {
+		passes += question.Passes
+		runs += question.Runs
+	}
+	if runs == 0 {
+		return 0
+	}
+	return 100 * float64(passes) / float64(runs)
+}
+
+// Tabulate prints the side-by-side comparison of the reports, one column per model.
+func Tabulate(writer io.Writer, reports []Report) {
+	if len(reports) == 0 || len(reports[0].Questions) == 0 {
+		return
+	}
+	const width = 48
+	shorten := func(text string) string {
+		runes := []rune(text)
+		if len(runes) > width {
+			return string(runes[:width-1]) + "…"
+		}
+		return text
+	}
+	column := 8
+	for _, report := range reports {
+		if len([]rune(report.Model)) > column {
+			column = len([]rune(report.Model))
+		}
+	}
+	cell := func(text, color string) string {
+		padding := column - len([]rune(text))
+		return color + text + NORMAL + strings.Repeat(" ", padding+2)
+	}
+	label := func(text string) string {
+		text = shorten(text)
+		return text + strings.Repeat(" ", width-len([]rune(text))+2)
+	}
+
+	fmt.Fprintln(writer)
+	fmt.Fprintln(writer, "Comparison")
+	fmt.Fprintln(writer, "----------")
+	fmt.Fprint(writer, label(""))
+	for _, report := range reports {
+		fmt.Fprint(writer, cell(report.Model, BOLD))
+	}
+	fmt.Fprintln(writer)
+	for index, row := range verdicts(reports) {
+		fmt.Fprint(writer, label(reports[0].Questions[index].Inquiry))
+		for column, value := range row {
+			color := YELLOW
+			switch reports[column].Questions[index].Status {
+			case "pass":
+				color, value = GREEN, CHECK
+			case "fail":
+				color, value = RED, CROSS
+			}
+			fmt.Fprint(writer, cell(value, color))
+		}
+		fmt.Fprintln(writer)
+	}
+	fmt.Fprint(writer, label("Accuracy"))
+	for _, report := range reports {
+		fmt.Fprint(writer, cell(fmt.Sprintf("%.1f%%", accuracy(report)), CYAN))
+	}
+	fmt.Fprintln(writer)
+	fmt.Fprint(writer, label("Median latency"))
+	for _, report := range reports {
+		fmt.Fprint(writer, cell(fmt.Sprintf("%d ms", report.MedianLatency), GRAY))
+	}
+	fmt.Fprintln(writer)
+}
+
+// ExportCSV writes the side-by-side comparison of the reports as a CSV file.
+func ExportCSV(reports []Report, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	header := []string{"file", "story", "inquiry"}
+	for _, report := range reports {
+		header = append(header, report.Model)
+	}
+	writer.Write(header)
+	for index, row := range verdicts(reports) {
+		question := reports[0].Questions[index]
+		writer.Write(append([]string{question.File, question.Story, question.Inquiry}, row...))
+	}
+	accuracies := []string{"", "", "accuracy (%)"}
+	latencies := []string{"", "", "median latency (ms)"}
+	for _, report := range reports {
+		accuracies = append(accuracies, fmt.Sprintf("%.1f", accuracy(report)))
+		latencies = append(latencies, fmt.Sprintf("%d", report.MedianLatency))
+	}
+	writer.Write(accuracies)
+	writer.Write(latencies)
+	writer.Flush()
+	return writer.Error()
+}
+
+// ExportHTML writes the side-by-side comparison of the reports as a self-contained HTML page.
+func ExportHTML(reports []Report, filename string) error {
+	const page = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Model comparison</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ddd; padding: 4px 8px; }
+th { background: #f4f4f4; }
+td.pass { background: #dff5e1; text-align: center; }
+td.fail { background: #fbe0e0; text-align: center; }
+td.flaky { background: #fff4d6; text-align: center; }
+tfoot td { font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>Model comparison</h1>
+<table>
+<thead>
+<tr><th>Story</th><th>Inquiry</th>{{range .Reports}}<th>{{.Model}}<br><small>{{.BaseURL}}</small></th>{{end}}</tr>
+</thead>
+<tbody>
+{{range .Rows}}<tr><td>{{.Story}}</td><td>{{.Inquiry}}</td>{{range .Cells}}<td class="{{.Status}}" title="{{.Answer}}">{{.Label}}</td>{{end}}</tr>
+{{end}}</tbody>
+<tfoot>
+<tr><td colspan="2">Accuracy</td>{{range .Accuracies}}<td>{{printf "%.1f" .}}%</td>{{end}}</tr>
+<tr><td colspan="2">Median latency</td>{{range .Reports}}<td>{{.MedianLatency}} ms</td>{{end}}</tr>
+</tfoot>
+</table>
+</body>
+</html>
+`
+	type Cell struct {
+		Status string
+		Label  string
+		Answer string
+	}
+	type Row struct {
+		Story   string
+		Inquiry string
+		Cells   []Cell
+	}
+	var rows []Row
+	for index, labels := range verdicts(reports) {
+		question := reports[0].Questions[index]
+		row := Row{Story: question.Story, Inquiry: question.Inquiry}
+		for column, label := range labels {
+			current := reports[column].Questions[index]
+			answer := ""
+			if len(current.Outcomes) > 0 {
+				answer = current.Outcomes[len(current.Outcomes)-1].Answer
+			}
+			row.Cells = append(row.Cells, Cell{Status: current.Status, Label: label, Answer: answer})
+		}
+		rows = append(rows, row)
+	}
+	var accuracies []float64
+	for _, report := range reports {
+		accuracies = append(accuracies, accuracy(report))
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return template.Must(template.New("comparison").Parse(page)).Execute(file, map[string]interface{}{
+		"Reports":    reports,
+		"Rows":       rows,
+		"Accuracies": accuracies,
+	})
+}
+
+// markup converts the text, possibly formatted with ANSI colors, into HTML.
+func markup(text string) template.HTML {
+	classes := map[string]string{
+		BOLD:    "bold",
+		YELLOW:  "yellow",
+		MAGENTA: "magenta",
+		RED:     "red",
+		GREEN:   "green",
+		CYAN:    "cyan",
+		GRAY:    "gray",
+	}
+	var result strings.Builder
+	depth := 0
+	last := 0
+	for _, span := range regexp.MustCompile("\x1b\\[[0-9;]*m").FindAllStringIndex(text, -1) {
+		result.WriteString(template.HTMLEscapeString(text[last:span[0]]))
+		code := text[span[0]:span[1]]
+		if code == NORMAL {
+			result.WriteString(strings.Repeat("</span>", depth))
+			depth = 0
+		} else {
+			result.WriteString(`<span class="` + classes[code] + `">`)
+			depth++
+		}
+		last = span[1]
+	}
+	result.WriteString(template.HTMLEscapeString(text[last:]))
+	result.WriteString(strings.Repeat("</span>", depth))
+	return template.HTML(result.String())
+}
+
+// ExportReview writes the pipeline review of every turn as a self-contained HTML file:
+// the timeline of the stages, the prompts sent to the LLM, the raw and parsed completions,
+// as well as the verdict of every assertion.
+func (client *Client) ExportReview(questions []Question, filename string) error {
+	const page = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Pipeline review</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+details { margin: 4px 0; }
+summary { cursor: pointer; }
+pre { background: #f7f7f7; padding: 6px; margin: 2px 0 8px 0; white-space: pre-wrap; }
+table { border-collapse: collapse; margin: 4px 0; }
+th, td { border: 1px solid #ddd; padding: 2px 8px; text-align: left; vertical-align: top; }
+th { background: #f4f4f4; }
+details.turn { border-left: 4px solid #ccc; padding-left: 8px; }
+details.turn.pass { border-color: #3a3; }
+details.turn.fail { border-color: #d33; }
+ol.timeline { border-left: 2px dotted #aaa; padding-left: 2em; }
+.meta, .gray { color: #888; }
+.bold { font-weight: bold; }
+.red { color: #d33; }
+.green { color: #282; background: #dff5e1; }
+.yellow { color: #a70; }
+.magenta { color: #a3a; }
+.cyan { color: #178; }
+.role { font-weight: bold; color: #a3a; }
+</style>
+</head>
+<body>
+<h1>Pipeline review</h1>
+<p class="meta">{{.Model}} at {{.BaseURL}}, generated on {{.Time}}</p>
+{{range .Turns}}<details class="turn {{.Status}}"{{if eq .Status "fail"}} open{{end}}>
+<summary>{{if eq .Status "pass"}}{{$.Check}}{{else if eq .Status "fail"}}{{$.Cross}}{{end}} <b>{{.Inquiry}}</b> <span class="meta">{{if .Story}}{{.Story}} · {{end}}{{if .Run}}run #{{.Run}} · {{end}}{{.Duration}} ms{{if .Tokens}} · {{.Tokens}}{{end}}</span></summary>
+<p>Answer: {{.Answer}}</p>
+{{if .Checks}}<table>
+<tr><th>Assertion</th><th>Expectation</th><th>Actual</th></tr>
+{{range .Checks}}<tr class="{{if .Passed}}pass{{else}}fail{{end}}"><td>{{if .Passed}}{{$.Check}}{{else}}<span class="red">{{$.Cross}}</span>{{end}} {{.Role}}</td><td>{{markup .Expectation}}</td><td>{{markup .Actual}}</td></tr>
+{{end}}</table>
+{{end}}{{if .Failures}}<p class="red">Failure reasons:</p>
+<ul>{{range .Failures}}<li class="red">{{.}}</li>{{end}}</ul>
+{{end}}<ol class="timeline">
+{{range .Stages}}<li><details>
+<summary><b>{{.Name}}</b> <span class="meta">[{{.Duration}} ms]</span></summary>
+{{if .Fields}}<table>
+{{range .Fields}}<tr><th>{{.Key}}</th><td>{{.Value}}</td></tr>
+{{end}}</table>
+{{end}}{{range .Exchanges}}<details>
+<summary>LLM call #{{.Attempt}} <span class="meta">[{{.Duration}} ms, {{.PromptTokens}} prompt + {{.CompletionTokens}} completion]</span></summary>
+{{range .Messages}}<div class="role">{{.Role}}</div><pre>{{.Content}}</pre>
+{{end}}{{if .Schema}}<div class="role">schema</div><pre>{{json .Schema}}</pre>
+{{end}}{{if .Error}}<p class="red">ERROR: {{.Error}}</p>
+{{else}}<div class="role">raw completion</div><pre>{{.Completion}}</pre>
+{{if .Breakdown}}<div class="role">parsed completion</div><table>
+{{range $key, $value := .Breakdown}}<tr><th>{{$key}}</th><td>{{$value}}</td></tr>
+{{end}}</table>
+{{end}}{{end}}</details>
+{{end}}</details></li>
+{{end}}</ol>
+</details>
+{{end}}</body>
+</html>
+`
+	type Field struct {
+		Key   string
+		Value interface{}
+	}
+	type Step struct {
+		Name      string
+		Duration  int64
+		Fields    []Field
+		Exchanges []Record
+	}
+	type Turn struct {
+		Story    string
+		Inquiry  string
+		Run      int
+		Status   string
+		Answer   string
+		Duration int64
+		Tokens   string
+		Checks   []Check
+		Failures []string
+		Stages   []Step
+	}
+
+	var turns []Turn
+	for _, question := range questions {
+		for index, outcome := range question.Outcomes {
+			turn := Turn{
+				Story:    question.Story,
+				Inquiry:  question.Inquiry,
+				Answer:   outcome.Answer,
+				Duration: outcome.Duration,
+				Checks:   outcome.Checks,
+				Failures: outcome.Failures,
+			}
+			if len(question.Outcomes) > 1 {
+				turn.Run = index + 1
+			}
+			if len(outcome.Checks) > 0 || len(outcome.Failures) > 0 {
+				turn.Status = "fail"
+				if outcome.Passed {
+					turn.Status = "pass"
+				}
+			}
+			if outcome.PromptTokens+outcome.CompletionTokens > 0 {
+				turn.Tokens = client.expense(Usage{outcome.PromptTokens, outcome.CompletionTokens}, outcome.Model, outcome.Exchanges)
+			}
+			for _, stage := range outcome.Stages {
+				step := Step{Name: stage.Name, Duration: stage.Duration}
+				for _, key := range arrange(stage.Fields) {
+					step.Fields = append(step.Fields, Field{Key: key, Value: stage.Fields[key]})
+				}
+				for _, exchange := range outcome.Exchanges {
+					if exchange.Stage == stage.Name {
+						step.Exchanges = append(step.Exchanges, exchange)
+					}
+				}
+				turn.Stages = append(turn.Stages, step)
+			}
+			turns = append(turns, turn)
+		}
+	}
+
+	functions := template.FuncMap{
+		"markup": markup,
+		"json": func(value interface{}) string {
+			jsonData, _ := json.MarshalIndent(value, "", "  ")
+			return string(jsonData)
+		},
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return template.Must(template.New("review").Funcs(functions).Parse(page)).Execute(file, map[string]interface{}{
+		"BaseURL": client.BaseURL,
+		"Model":   client.ChatModel,
+		"Time":    time.Now().Format(time.RFC1123),
+		"Check":   CHECK,
+		"Cross":   CROSS,
+		"Turns":   turns,
+	})
+}
+
+// LoadBaseline reads the baseline saved from an earlier evaluation, and checks that it is usable:
+// every snapshot must identify its inquiry, and no two snapshots may refer to the same turn.
+func LoadBaseline(filename string) ([]Snapshot, error) {
+	jsonData, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var baseline []Snapshot
+	if err := json.Unmarshal(jsonData, &baseline); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	seen := make(map[string]bool)
+	for index, snapshot := range baseline {
+		if snapshot.File == "" || snapshot.Inquiry == "" {
+			return nil, fmt.Errorf("%s: snapshot #%d has no file or inquiry", filename, index+1)
+		}
+		key := Identify(snapshot.File, snapshot.StoryIndex, snapshot.TurnIndex)
+		if seen[key] {
+			return nil, fmt.Errorf("%s: snapshot #%d refers to the same turn as an earlier one (saved by an older version?)", filename, index+1)
+		}
+		seen[key] = true
+	}
+	return baseline, nil
+}
+
+// Baseline captures the outcome of every question, to be used as a baseline for a later evaluation.
+func Baseline(questions []Question) []Snapshot {
+	var snapshots []Snapshot
+	for _, question := range questions {
+		if len(question.Outcomes) == 0 {
+			continue
+		}
+		outcome := question.Outcomes[0]
+		snapshots = append(snapshots, Snapshot{
+			File:       question.File,
+			Story:      question.Story,
+			StoryIndex: question.StoryIndex,
+			TurnIndex:  question.TurnIndex,
+			Inquiry:    question.Inquiry,
+			Answer:     outcome.Answer,
+			Keyphrases: outcome.Keyphrases,
+			Topic:      outcome.Topic,
+			Passed:     question.Status == "pass",
+			Duration:   outcome.Duration,
+		})
+	}
+	return snapshots
+}
+
+// difference produces a word-by-word textual diff, marking the removed words as [-...-]
+// and the added words as {+...+}.
+func difference(before, after string) string {
+	a := strings.Fields(before)
+	b := strings.Fields(after)
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var result []string
+	var removed, added []string
+	flush := func() {
+		if len(removed) > 0 {
+			result = append(result, RED+"[-"+strings.Join(removed, " ")+"-]"+NORMAL)
+			removed = nil
+		}
+		if len(added) > 0 {
+			result = append(result, GREEN+"{+"+strings.Join(added, " ")+"+}"+NORMAL)
+			added = nil
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		if i < len(a) && j < len(b) && a[i] == b[j] {
+			flush()
+			result = append(result, a[i])
+			i++
+			j++
+		} else if j >= len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]) {
+			removed = append(removed, a[i])
+			i++
+		} else {
+			added = append(added, b[j])
+			j++
+		}
+	}
+	flush()
+	return strings.Join(result, " ")
+}
+
+// Regression reports the questions which newly fail, newly pass, or have a changed answer,
+// compared to the baseline.
+func Regression(writer io.Writer, baseline, current []Snapshot) {
+	key := func(snapshot Snapshot) string {
+		return Identify(snapshot.File, snapshot.StoryIndex, snapshot.TurnIndex)
+	}
+	previous := make(map[string]Snapshot)
+	for _, snapshot := range baseline {
+		previous[key(snapshot)] = snapshot
+	}
+
+	var failing, passing, changed, added []Snapshot
+	seen := make(map[string]bool)
+	for _, snapshot := range current {
+		before, exists := previous[key(snapshot)]
+		if !exists {
+			added = append(added, snapshot)
+		} else if before.Passed && !snapshot.Passed {
+			failing = append(failing, snapshot)
+		} else if !before.Passed && snapshot.Passed {
+			passing = append(passing, snapshot)
+		} else if before.Answer != snapshot.Answer {
+			changed = append(changed, snapshot)
+		}
+		seen[key(snapshot)] = true
+	}
+	missing := 0
+	for name := range previous {
+		if !seen[name] {
+			missing++
+		}
+	}
+
+	show := func(snapshot Snapshot) {
+		before := previous[key(snapshot)]
+		fmt.Fprintf(writer, "  %s%s %s[%d ms %s %d ms]%s\n", CYAN, snapshot.Inquiry, GRAY, before.Duration, ARROW, snapshot.Duration, NORMAL)
+		fmt.Fprintf(writer, "    %s\n", difference(before.Answer, snapshot.Answer))
+		if before.Keyphrases != snapshot.Keyphrases {
+			fmt.Fprintf(writer, "    %sKeyphrases:%s %s\n", GRAY, NORMAL, difference(before.Keyphrases, snapshot.Keyphrases))
+		}
+		if before.Topic != snapshot.Topic {
+			fmt.Fprintf(writer, "    %sTopic:%s %s\n", GRAY, NORMAL, difference(before.Topic, snapshot.Topic))
+		}
+	}
+
+	fmt.Fprintln(writer)
+	fmt.Fprintln(writer, "Baseline comparison")
+	fmt.Fprintln(writer, "-------------------")
+	if len(failing) > 0 {
+		fmt.Fprintf(writer, "%s%s Newly failing: %d%s\n", RED, CROSS, len(failing), NORMAL)
+		for _, snapshot := range failing {
+			show(snapshot)
+		}
+	}
+	if len(passing) > 0 {
+		fmt.Fprintf(writer, "%s%s Newly passing: %d%s\n", GREEN, CHECK, len(passing), NORMAL)
+		for _, snapshot := range passing {
+			show(snapshot)
+		}
+	}
+	if len(changed) > 0 {
+		fmt.Fprintf(writer, "%s%s Changed answers: %d%s\n", YELLOW, ARROW, len(changed), NORMAL)
+		for _, snapshot := range changed {
+			show(snapshot)
+		}
+	}
+	if len(added) > 0 {
+		fmt.Fprintf(writer, "%sNot in the baseline: %d%s\n", GRAY, len(added), NORMAL)
+	}
+	if missing > 0 {
+		fmt.Fprintf(writer, "%sMissing from this run: %d%s\n", GRAY, missing, NORMAL)
+	}
+	if len(failing)+len(passing)+len(changed) == 0 {
+		fmt.Fprintf(writer, "%sNo difference from the baseline.%s\n", GRAY, NORMAL)
+	}
+}
+
+// present pretty-prints a turn from the trace log, along with its exchanges with the LLM.
+// The turn is nil if the trace log does not contain its completion, e.g. due to a timeout.
+func (client *Client) present(turn *Record, exchanges []Record) {
+	first := turn
+	if first == nil {
+		first = &exchanges[0]
+	}
+	fmt.Fprintln(client.Output)
+	if first.Story != "" {
+		fmt.Fprintf(client.Output, "%sStory: %s%s%s%s\n", GRAY, MAGENTA, BOLD, first.Story, NORMAL)
+	}
+	if turn == nil {
+		fmt.Fprintf(client.Output, "%s%s %s%s %s(incomplete)%s\n", RED, CROSS, YELLOW, first.Inquiry, GRAY, NORMAL)
+	} else if turn.Error != "" || (turn.Passed != nil && !*turn.Passed) {
+		fmt.Fprintf(client.Output, "%s%s %s%s %s[%d ms]%s\n", RED, CROSS, YELLOW, turn.Inquiry, GRAY, turn.Duration, NORMAL)
+	} else {
+		fmt.Fprintf(client.Output, "%s%s %s%s %s[%d ms]%s\n", GREEN, CHECK, CYAN, turn.Inquiry, GRAY, turn.Duration, NORMAL)
+	}
+	fmt.Fprintf(client.Output, "%s  %s (%s) at %s%s\n", GRAY, first.Model, first.Turn, first.Time, NORMAL)
+
+	for _, exchange := range exchanges {
+		fmt.Fprintln(client.Output)
+		fmt.Fprintf(client.Output, "  %s%s %s #%d%s %s[%d ms, %s]%s\n", BOLD, ARROW, exchange.Stage, exchange.Attempt, NORMAL,
+			GRAY, exchange.Duration, client.expense(Usage{exchange.PromptTokens, exchange.CompletionTokens}, exchange.Model, nil), NORMAL)
+		for _, message := range exchange.Messages {
+			fmt.Fprintf(client.Output, "  %s%s:%s %s\n", MAGENTA, message.Role, NORMAL, strings.ReplaceAll(message.Content, "\n", "\n    "))
+		}
+		if exchange.Schema != nil {
+			jsonData, _ := json.Marshal(exchange.Schema)
+			fmt.Fprintf(client.Output, "  %sschema:%s %s\n", MAGENTA, NORMAL, jsonData)
+		}
+		if exchange.Error != "" {
+			fmt.Fprintf(client.Output, "  %sERROR: %s%s\n", RED, exchange.Error, NORMAL)
+			continue
+		}
+		fmt.Fprintf(client.Output, "  %scompletion:%s %s\n", GREEN, NORMAL, strings.ReplaceAll(exchange.Completion, "\n", "\n    "))
+		keys := make([]string, 0, len(exchange.Breakdown))
+		for key := range exchange.Breakdown {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(client.Output, "    %s%s:%s %s\n", GRAY, key, NORMAL, exchange.Breakdown[key])
+		}
+	}
+
+	if turn != nil {
+		fmt.Fprintln(client.Output)
+		if turn.Answer != "" {
+			fmt.Fprintln(client.Output, "  Answer:", turn.Answer)
+		}
+		if turn.PromptTokens+turn.CompletionTokens > 0 {
+			fmt.Fprintf(client.Output, "  %sTokens: %s%s\n", GRAY, client.expense(Usage{turn.PromptTokens, turn.CompletionTokens}, turn.Model, exchanges), NORMAL)
+		}
+		for _, failure := range turn.Failures {
+			fmt.Fprintf(client.Output, "  %s%s%s\n", RED, failure, NORMAL)
+		}
+		if turn.Error != "" {
+			fmt.Fprintf(client.Output, "  %sERROR: %s%s\n", RED, turn.Error, NORMAL)
+		}
+	}
+}
+
+// Show prints every turn recorded in the trace log which matches the filter.
+// Only the exchanges of the given stage are shown, unless the stage is empty.
+// With raw, the matching records are printed as they are, one JSON per line.
+func (client *Client) Show(filename string, filter Filter, stage string, failed bool, raw bool) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var order []string
+	turns := make(map[string]*Record)
+	exchanges := make(map[string][]Record)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return fmt.Errorf("%s:%d: %v", filename, number, err)
+		}
+		if _, exists := turns[record.Turn]; !exists {
+			if _, exists := exchanges[record.Turn]; !exists {
+				order = append(order, record.Turn)
+			}
+		}
+		if record.Type == "turn" {
+			turns[record.Turn] = &record
+		} else if stage == "" || strings.EqualFold(stage, record.Stage) {
+			exchanges[record.Turn] = append(exchanges[record.Turn], record)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	count := 0
+	for _, id := range order {
+		turn := turns[id]
+		first := turn
+		if first == nil {
+			if len(exchanges[id]) == 0 {
+				continue
+			}
+			first = &exchanges[id][0]
+		}
+		if filter.Story != nil && !filter.Story.MatchString(first.Story) {
+			continue
+		}
+		if filter.Grep != nil && !filter.Grep.MatchString(first.Inquiry) {
+			continue
+		}
+		if failed && turn != nil && turn.Error == "" && (turn.Passed == nil || *turn.Passed) {
+			continue
+		}
+		count++
+		if raw {
+			for _, record := range exchanges[id] {
+				jsonData, _ := json.Marshal(record)
+				fmt.Fprintln(client.Output, string(jsonData))
+			}
+			if turn != nil {
+				jsonData, _ := json.Marshal(turn)
+				fmt.Fprintln(client.Output, string(jsonData))
+			}
+			continue
+		}
+		client.present(turn, exchanges[id])
 	}
-	if len(args) == 0 {
-		interact()
+	if !raw {
+		fmt.Fprintln(client.Output)
+		fmt.Fprintf(client.Output, "%s%d turn(s) shown.%s\n", GRAY, count, NORMAL)
 	}
+	return nil
 }
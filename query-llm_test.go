@@ -0,0 +1,414 @@
+package queryllm
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestStreamer(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		path   string
+		answer string
+	}{
+		{"plain", `{"answer":"Hello, world!"}`, "answer", "Hello, world!"},
+		{"escapes", `{"answer":"a\"b\\c\/d\ne\tf"}`, "answer", "a\"b\\c/d\ne\tf"},
+		{"unicode escape", `{"answer":"caf\u00e9"}`, "answer", "café"},
+		{"surrogate pair", `{"answer":"smile \ud83d\ude00!"}`, "answer", "smile 😀!"},
+		{"lone high surrogate", `{"answer":"\ud83dx"}`, "answer", "\ufffdx"},
+		{"two high surrogates", `{"answer":"\ud83d\ud83d"}`, "answer", "\ufffd\ufffd"},
+		{"high surrogate at the end", `{"answer":"x\ud83d"}`, "answer", "x\ufffd"},
+		{"high surrogate before an escaped character", `{"answer":"\ud83d\u0041"}`, "answer", "\ufffdA"},
+		{"high surrogate before an escaped newline", `{"answer":"\ud83d\n"}`, "answer", "\ufffd\n"},
+		{"lone low surrogate", `{"answer":"\ude00x"}`, "answer", "\ufffdx"},
+		{"multibyte", `{"answer":"Größe 😀 日本"}`, "answer", "Größe 😀 日本"},
+		{"fence", "```json\n{\"answer\": \"42\"}\n```", "answer", "42"},
+		{"after other fields", `{"topic":"x","count":3,"flag":true,"answer":"yes"}`, "answer", "yes"},
+		{"nested", `{"a":{"b":["x","y"]},"answer":"z"}`, "a.b.1", "y"},
+		{"key with escape", `{"an\u0073wer":"ok"}`, "answer", "ok"},
+	}
+	for _, test := range tests {
+		// the decoding must agree with encoding/json, e.g. for the invalid surrogates
+		var document map[string]interface{}
+		if json.Unmarshal([]byte(test.text), &document) == nil {
+			if value, found := document[test.path].(string); found && value != test.answer {
+				t.Errorf("%s: encoding/json decodes %q, expected %q", test.name, value, test.answer)
+			}
+		}
+		// feed the text in chunks of every size, so that the chunk boundaries fall
+		// inside the escape sequences and inside the multibyte characters
+		for size := 1; size <= len(test.text); size++ {
+			var fragments []string
+			streamer := NewStreamer(func(path, fragment string) {
+				if path == test.path {
+					fragments = append(fragments, fragment)
+				}
+			})
+			for start := 0; start < len(test.text); start += size {
+				end := start + size
+				if end > len(test.text) {
+					end = len(test.text)
+				}
+				streamer.Write(test.text[start:end])
+			}
+			for _, fragment := range fragments {
+				if !utf8.ValidString(fragment) {
+					t.Errorf("%s (chunk %d): invalid UTF-8 fragment %q", test.name, size, fragment)
+				}
+			}
+			if answer := strings.Join(fragments, ""); answer != test.answer {
+				t.Errorf("%s (chunk %d): emitted %q, expected %q", test.name, size, answer, test.answer)
+			}
+			if value := streamer.Value(test.path); value != test.answer {
+				t.Errorf("%s (chunk %d): value %q, expected %q", test.name, size, value, test.answer)
+			}
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	schema := map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"topic":  map[string]interface{}{"type": "string"},
+			"tool":   map[string]interface{}{"type": "string", "enum": []string{"search", "none"}},
+			"count":  map[string]interface{}{"type": "integer"},
+			"score":  map[string]interface{}{"type": "number"},
+			"labels": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+			"note":   map[string]interface{}{"type": []string{"string", "null"}},
+		},
+		"required":             []string{"topic"},
+		"additionalProperties": false,
+	}
+	tests := []struct {
+		name       string
+		document   string
+		violations []string
+	}{
+		{"valid", `{"topic":"x","tool":"none","count":2,"score":0.5,"labels":["a"],"note":null}`, nil},
+		{"integer as number", `{"topic":"x","score":3}`, nil},
+		{"wrong type", `{"topic":7}`, []string{"$.topic: expected string, got integer"}},
+		{"not an object", `["topic"]`, []string{"$: expected object, got array"}},
+		{"enum", `{"topic":"x","tool":"calculator"}`, []string{"$.tool: calculator is not one of [search none]"}},
+		{"fraction for integer", `{"topic":"x","count":1.5}`, []string{"$.count: expected integer, got number"}},
+		{"missing required", `{"tool":"none"}`, []string{`$: missing required property "topic"`}},
+		{"additional property", `{"topic":"x","extra":1}`, []string{`$: unexpected property "extra"`}},
+		{"items", `{"topic":"x","labels":["a",2]}`, []string{"$.labels[1]: expected string, got integer"}},
+		{"type list", `{"topic":"x","note":false}`, []string{"$.note: expected [string null], got boolean"}},
+	}
+	for _, test := range tests {
+		var value interface{}
+		if err := json.Unmarshal([]byte(test.document), &value); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if violations := validate(schema, value, "$"); !reflect.DeepEqual(violations, test.violations) {
+			t.Errorf("%s: got %q, expected %q", test.name, violations, test.violations)
+		}
+	}
+
+	additional := map[string]interface{}{
+		"type":                 "object",
+		"additionalProperties": map[string]interface{}{"type": "string"},
+	}
+	var value interface{}
+	json.Unmarshal([]byte(`{"a":"x","b":1}`), &value)
+	expected := []string{"$.b: expected string, got integer"}
+	if violations := validate(additional, value, "$"); !reflect.DeepEqual(violations, expected) {
+		t.Errorf("additionalProperties schema: got %q, expected %q", violations, expected)
+	}
+}
+
+func TestUnYAML(t *testing.T) {
+	text := `# profiles
+default: local
+local:
+  base_url: http://127.0.0.1:8080/v1   # llama.cpp
+  streaming: no
+  json_schema: yes
+  model: "gpt-4o # not a comment"
+  api_key: 'it''s'
+  stages:
+    reason:
+      model: small
+  empty:
+`
+	expected := map[string]interface{}{
+		"default": "local",
+		"local": map[string]interface{}{
+			"base_url":    "http://127.0.0.1:8080/v1",
+			"streaming":   false,
+			"json_schema": true,
+			"model":       "gpt-4o # not a comment",
+			"api_key":     "it's",
+			"stages": map[string]interface{}{
+				"reason": map[string]interface{}{"model": "small"},
+			},
+			"empty": nil,
+		},
+	}
+	result, err := unYAML(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("got %v, expected %v", result, expected)
+	}
+
+	invalid := map[string]string{
+		"list":              "models:\n  - a\n",
+		"tab":               "a:\n\tb: c\n",
+		"missing colon":     "just text\n",
+		"bad indentation":   "a: 1\n  b: 2\n",
+		"unterminated":      "a: \"open\n",
+		"text after quotes": "a: \"x\" y\n",
+	}
+	for name, text := range invalid {
+		if _, err := unYAML(text); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestRecognize(t *testing.T) {
+	tests := []struct {
+		text     string
+		language string
+	}{
+		{"Which river flows through the capital of Egypt?", "English"},
+		{"Welcher Fluss fließt durch die Hauptstadt von Ägypten?", "German"},
+		{"Quel fleuve traverse la capitale de l'Égypte ?", "French"},
+		{"¿Qué río atraviesa la capital de Egipto?", "Spanish"},
+		{"Sungai apa yang mengalir melalui ibu kota Mesir?", "Indonesian"},
+		{"Welke rivier stroomt door de hoofdstad van Egypte?", "Dutch"},
+		{"Wer hat die spezielle Relativitätstheorie entwickelt?", "German"},
+		{"Gunung apa yang paling tinggi di dunia?", "Indonesian"},
+		{"42", ""},
+	}
+	for _, test := range tests {
+		if language, score := Recognize(test.text); language != test.language {
+			t.Errorf("%q: got %q (%.2f), expected %q", test.text, language, score, test.language)
+		}
+	}
+}
+
+func TestPassAtK(t *testing.T) {
+	tests := []struct {
+		n, c, k  int
+		expected float64
+	}{
+		{5, 0, 1, 0},
+		{5, 5, 1, 1},
+		{5, 1, 1, 0.2},
+		{5, 2, 1, 0.4},
+		{5, 1, 5, 1},
+		{4, 2, 2, 1 - 1.0/6},
+		{10, 3, 3, 1 - 35.0/120},
+	}
+	for _, test := range tests {
+		if result := passAtK(test.n, test.c, test.k); math.Abs(result-test.expected) > 1e-9 {
+			t.Errorf("passAtK(%d, %d, %d) = %v, expected %v", test.n, test.c, test.k, result, test.expected)
+		}
+	}
+}
+
+func TestCriterion(t *testing.T) {
+	tests := []struct {
+		text     string
+		subject  string
+		operator string
+		limit    float64
+		ok       bool
+	}{
+		{"Jupiter is the largest planet >= 0.9", "Jupiter is the largest planet", ">=", 0.9, true},
+		{"words<50", "words", "<", 50, true},
+		{"  delta == -1.5  ", "delta", "==", -1.5, true},
+		{"score > .5", "score", ">", 0.5, true},
+		{"<= 3", "", "<=", 3, true},
+		{"Jupiter", "Jupiter", "", 0, false},
+		{"score >= high", "score >= high", "", 0, false},
+	}
+	for _, test := range tests {
+		subject, operator, limit, ok := criterion(test.text)
+		if subject != test.subject || operator != test.operator || limit != test.limit || ok != test.ok {
+			t.Errorf("criterion(%q) = %q, %q, %v, %v", test.text, subject, operator, limit, ok)
+		}
+	}
+}
+
+func TestPick(t *testing.T) {
+	stories := []Story{
+		{Name: "Planets", Tags: []string{"astronomy"}, Turns: []Turn{{Inquiry: "Which is the largest?"}, {Inquiry: "and the smallest?"}}},
+		{Name: "Oceans", Tags: []string{"geography"}, Turns: []Turn{{Inquiry: "Which is the largest?"}, {Inquiry: "and the smallest?"}}},
+	}
+	tests := []struct {
+		name     string
+		filter   Filter
+		selected []string // the key of every turn run loudly
+		silent   []string // the key of every turn run only for the history
+	}{
+		{"everything", Filter{}, []string{"x.txt#0.0", "x.txt#0.1", "x.txt#1.0", "x.txt#1.1"}, nil},
+		{"tags", Filter{Tags: []string{" Geography"}}, []string{"x.txt#1.0", "x.txt#1.1"}, nil},
+		{"story", Filter{Story: regexp.MustCompile("Planet")}, []string{"x.txt#0.0", "x.txt#0.1"}, nil},
+		{"grep", Filter{Grep: regexp.MustCompile("smallest")}, []string{"x.txt#0.1", "x.txt#1.1"}, []string{"x.txt#0.0", "x.txt#1.0"}},
+		{"failed", Filter{Failed: map[string]bool{Identify("./x.txt", 1, 0): true}}, []string{"x.txt#1.0"}, nil},
+	}
+	for _, test := range tests {
+		var selected, silent []string
+		for _, story := range pick(stories, "x.txt", test.filter) {
+			for _, turn := range story.Turns {
+				key := Identify("x.txt", story.Index, turn.Index)
+				if turn.Silent {
+					silent = append(silent, key)
+				} else {
+					selected = append(selected, key)
+				}
+			}
+		}
+		if !reflect.DeepEqual(selected, test.selected) || !reflect.DeepEqual(silent, test.silent) {
+			t.Errorf("%s: selected %q and silent %q, expected %q and %q", test.name, selected, silent, test.selected, test.silent)
+		}
+	}
+}
+
+func TestConform(t *testing.T) {
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": map[string]interface{}{"answer": map[string]interface{}{"type": "string"}},
+		"required":   []string{"answer"},
+	}
+	tests := []struct {
+		name        string
+		completions []string // one for every request, the last one repeated
+		valid       bool
+		repairs     int
+		answer      string
+	}{
+		{"valid", []string{`{"answer":"Jupiter"}`}, true, 0, `{"answer":"Jupiter"}`},
+		{"repaired", []string{`{"answer":42}`, `{"answer":"Jupiter"}`}, true, 1, `{"answer":"Jupiter"}`},
+		{"still invalid", []string{`{"answer":42}`, `{"answer":43}`, `{"answer":44}`}, false, MAX_REPAIR_ATTEMPT, `{"answer":44}`},
+		{"never JSON", []string{"Jupiter"}, false, MAX_REPAIR_ATTEMPT, "Jupiter"},
+	}
+	for _, test := range tests {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			completion := test.completions[len(test.completions)-1]
+			if requests < len(test.completions) {
+				completion = test.completions[requests]
+			}
+			requests++
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"choices": []interface{}{map[string]interface{}{"message": map[string]interface{}{"role": "assistant", "content": completion}}},
+				"usage":   map[string]interface{}{"prompt_tokens": 10, "completion_tokens": 5},
+			})
+		}))
+		config := initial()
+		config.BaseURL = server.URL
+		config.Streaming = false
+		client := NewClient(config)
+		completion, usage, validation, err := client.conform("Respond", Context{}, []Message{{Role: "user", Content: "Which planet is the largest?"}}, schema, nil)
+		server.Close()
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if completion != test.answer {
+			t.Errorf("%s: completion %q, expected %q", test.name, completion, test.answer)
+		}
+		if validation["valid"] != test.valid || validation["repairs"] != test.repairs {
+			t.Errorf("%s: validation %v, expected valid %v after %d repair(s)", test.name, validation, test.valid, test.repairs)
+		}
+		if violations, _ := validation["violations"].([]string); test.valid == (len(violations) > 0) {
+			t.Errorf("%s: violations %q", test.name, violations)
+		}
+		if usage.PromptTokens != 10*requests || requests != test.repairs+1 {
+			t.Errorf("%s: %d request(s) using %d prompt tokens", test.name, requests, usage.PromptTokens)
+		}
+	}
+}
+
+func TestBreakdown(t *testing.T) {
+	tests := []struct {
+		name       string
+		hint       string
+		completion string
+		topic      string
+		flaws      []string
+	}{
+		{"text", "tool: Google\nthought: ", "planets\nkeyphrases: largest planet\nobservation: Jupiter\ntopic: astronomy", "astronomy", nil},
+		{"JSON", "", `{"thought":"planets","topic":"astronomy"}`, "astronomy", nil},
+		{"missing topic", "tool: Google\nthought: ", "planets\nkeyphrases: largest planet", "", []string{"topic: missing"}},
+		{"invalid JSON", "", "{ oops\ntopic: astronomy", "astronomy", []string{"$: not valid JSON, parsed as text"}},
+	}
+	client := NewClient(initial())
+	for _, test := range tests {
+		result, flaws := client.breakdown(test.hint, test.completion)
+		if result["topic"] != test.topic || !reflect.DeepEqual(flaws, test.flaws) {
+			t.Errorf("%s: topic %q and flaws %q, expected %q and %q", test.name, result["topic"], flaws, test.topic, test.flaws)
+		}
+	}
+}
+
+func TestExpense(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "prices.json")
+	os.WriteFile(filename, []byte(`{"small": {"prompt": 1, "completion": 2}, "large": {"prompt": 10, "completion": 20}}`), 0644)
+	config := initial()
+	config.ChatModel = "small"
+	config.PriceTable = filename
+	client := NewClient(config)
+
+	usage := Usage{PromptTokens: 2000, CompletionTokens: 1000}
+	tests := []struct {
+		name      string
+		model     string
+		exchanges []Record
+		expected  string
+	}{
+		{"model", "large", nil, "2000 prompt + 1000 completion ($0.040000)"},
+		{"unknown model", "tiny", nil, "2000 prompt + 1000 completion"},
+		{"exchanges", "small", []Record{
+			{Model: "small", PromptTokens: 1000, CompletionTokens: 500},
+			{Model: "large", PromptTokens: 1000, CompletionTokens: 500},
+		}, "2000 prompt + 1000 completion ($0.022000)"},
+		{"unknown exchange", "small", []Record{
+			{Model: "small", PromptTokens: 1000, CompletionTokens: 500},
+			{Model: "tiny", PromptTokens: 1000, CompletionTokens: 500},
+		}, "2000 prompt + 1000 completion"},
+	}
+	for _, test := range tests {
+		if result := client.expense(usage, test.model, test.exchanges); result != test.expected {
+			t.Errorf("%s: %q, expected %q", test.name, result, test.expected)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	// every handler has its own mux, hence several servers may run in the same process
+	for i := 0; i < 2; i++ {
+		server := httptest.NewServer(NewClient(initial()).Handler())
+		response, err := http.Get(server.URL + "/v1/models")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var models struct {
+			Data []struct {
+				ID string `json:"id"`
+			} `json:"data"`
+		}
+		json.NewDecoder(response.Body).Decode(&models)
+		response.Body.Close()
+		server.Close()
+		if len(models.Data) != 1 || models.Data[0].ID != "query-llm" {
+			t.Errorf("server #%d: models %v", i+1, models.Data)
+		}
+	}
+}